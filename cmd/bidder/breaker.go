@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// The order API circuit breaker opens after breakerThreshold consecutive poll
+// cycles with a failed order check. While it is open the poll loop skips the
+// API and holds the clusters where they are; the first poll after
+// breakerCooldown is a probe that closes it on success or reopens it on
+// failure. All guarded by mu.
+var (
+	breakerFailures  int
+	breakerOpenUntil time.Time
+)
+
+type breakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+// breakerState returns "closed", "open" or "half-open". Callers must hold mu.
+func breakerState() string {
+	switch {
+	case breakerThreshold == 0 || breakerFailures < breakerThreshold:
+		return "closed"
+	case time.Now().Before(breakerOpenUntil):
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// breakerRemaining reports how long the breaker stays open, or zero if the
+// API may be polled.
+func breakerRemaining() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if breakerState() != "open" {
+		return 0
+	}
+	return time.Until(breakerOpenUntil)
+}
+
+// recordPollOutcome feeds one poll cycle's result to the breaker.
+func recordPollOutcome(failed bool) {
+	if breakerThreshold == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !failed {
+		if breakerFailures >= breakerThreshold {
+			slog.Info("Order API recovered, circuit breaker closed")
+		}
+		breakerFailures = 0
+		breakerOpenGauge.Set(0)
+		return
+	}
+
+	breakerFailures++
+	if breakerFailures >= breakerThreshold {
+		breakerOpenUntil = time.Now().Add(breakerCooldown)
+		breakerOpenGauge.Set(1)
+		slog.Warn("Order API circuit breaker open, holding current prover",
+			"consecutive_failures", breakerFailures, "retry_in", breakerCooldown.String())
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// clusterCheck is the outcome of checking one cluster.
+type clusterCheck struct {
+	cluster Cluster
+	latency time.Duration
+	output  string
+	err     error
+}
+
+// checkClusters runs "<compose command> version" on every cluster at once,
+// writes a PASS/FAIL table, or JSON if asJSON is set, to w and reports
+// whether every cluster passed. The command proves the SSH credentials and
+// host key are accepted and compose is installed, without touching any
+// prover. Each cluster gets one attempt of up to sshTimeout, so failures show
+// the underlying error rather than a retry.
+func checkClusters(ctx context.Context, w io.Writer, asJSON bool) bool {
+	results := make([]clusterCheck, len(clusters))
+	var wg sync.WaitGroup
+	for i, c := range clusters {
+		wg.Add(1)
+		go func(idx int, cluster Cluster) {
+			defer wg.Done()
+			results[idx] = checkCluster(ctx, cluster)
+		}(i, c)
+	}
+	wg.Wait()
+
+	if asJSON {
+		return writeChecksJSON(w, results)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tRESULT\tLATENCY\tDETAIL")
+	passed := 0
+	for _, r := range results {
+		result, detail := "PASS", r.output
+		if r.err != nil {
+			result, detail = "FAIL", r.err.Error()
+		} else {
+			passed++
+		}
+		if quarantined[clusterKey(r.cluster)] {
+			detail += " (quarantined)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", clusterKey(r.cluster), result,
+			r.latency.Round(time.Millisecond), detail)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d/%d clusters reachable\n", passed, len(results))
+	return passed == len(results)
+}
+
+type clusterCheckJSON struct {
+	Cluster     string `json:"cluster"`
+	OK          bool   `json:"ok"`
+	LatencyMS   int64  `json:"latency_ms"`
+	Output      string `json:"output,omitempty"`
+	Error       string `json:"error,omitempty"`
+	AuthFailed  bool   `json:"auth_failed,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+func writeChecksJSON(w io.Writer, results []clusterCheck) bool {
+	out := struct {
+		Clusters []clusterCheckJSON `json:"clusters"`
+		Passed   int                `json:"passed"`
+		Total    int                `json:"total"`
+	}{Clusters: make([]clusterCheckJSON, len(results)), Total: len(results)}
+	for i, r := range results {
+		c := clusterCheckJSON{
+			Cluster:     clusterKey(r.cluster),
+			OK:          r.err == nil,
+			LatencyMS:   r.latency.Milliseconds(),
+			Output:      r.output,
+			Quarantined: quarantined[clusterKey(r.cluster)],
+		}
+		if r.err != nil {
+			c.Error = r.err.Error()
+			c.AuthFailed = sshAuthFailed(r.err)
+		} else {
+			out.Passed++
+		}
+		out.Clusters[i] = c
+	}
+	writeJSON(w, out)
+	return out.Passed == out.Total
+}
+
+func checkCluster(ctx context.Context, cluster Cluster) clusterCheck {
+	select {
+	case sshSem <- struct{}{}:
+		defer func() { <-sshSem }()
+	case <-ctx.Done():
+		return clusterCheck{cluster: cluster, err: ctx.Err()}
+	}
+
+	cfg, err := sshClientConfig(cluster)
+	if err != nil {
+		return clusterCheck{cluster: cluster, err: fmt.Errorf("ssh config: %w", err)}
+	}
+
+	cmdCtx, cancel := context.WithTimeout(ctx, sshTimeout)
+	defer cancel()
+	start := time.Now()
+	out, err := runSSH(cmdCtx, cluster, cfg, cluster.compose()+" version")
+	check := clusterCheck{cluster: cluster, latency: time.Since(start), err: err}
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			check.err = fmt.Errorf("%w: %s", err, firstLine(msg))
+		}
+		return check
+	}
+	check.output = firstLine(strings.TrimSpace(string(out)))
+	return check
+}
+
+// firstLine returns s up to its first newline.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
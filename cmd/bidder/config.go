@@ -0,0 +1,1325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultSSHPort      = 22
+	defaultPollInterval = 5 * time.Second
+	minPollInterval     = 500 * time.Millisecond
+	defaultSSHTimeout   = 30 * time.Second
+	defaultSSHRetries   = 3
+	defaultAPITimeout   = 10 * time.Second
+	defaultAPIRetries   = 3
+	defaultDebounce     = 3
+	defaultCooldown     = 60 * time.Second
+	defaultReconcile    = time.Minute
+	defaultStatusPort   = 8080
+	defaultStateFile    = "bidder-state.json"
+	defaultConcurrency  = 10
+	defaultFallback     = 1
+	defaultPollJitter   = 0.1
+	defaultHistorySize  = 100
+	defaultComposeCmd   = "docker compose"
+	defaultBreakerWait  = time.Minute
+	defaultDrainTimeout = 5 * time.Minute
+	defaultProbeTimeout = 2 * time.Minute
+	defaultHookTimeout  = 30 * time.Second
+	defaultServeAction  = "unpause"
+	defaultIdleAction   = "pause"
+	defaultKnownHosts   = "~/.ssh/known_hosts"
+	defaultControlRate  = 30
+	defaultControlBurst = 5
+
+	switchStopFirst  = "stop_first"
+	switchStartFirst = "start_first"
+
+	fallbackAllFailed = "all_failed"
+	fallbackAnyFailed = "any_failed"
+
+	orderSourceProver = "prover"
+	orderSourceGroup  = "group"
+
+	hostKeyNo        = "no"
+	hostKeyAcceptNew = "accept-new"
+	hostKeyYes       = "yes"
+
+	// maxSplitRatio bounds SPLIT_RATIO entries so their scaled weights can't
+	// overflow the allocation.
+	maxSplitRatio = 1e6
+)
+
+type ProverConfig struct {
+	Address string `yaml:"address"`
+	Folder  string `yaml:"folder"`
+	// ComposeFile is passed to docker compose as -f, relative to Folder.
+	ComposeFile string `yaml:"compose_file"`
+	// Project is passed to docker compose as -p, so the prover's project
+	// doesn't depend on its folder's name.
+	Project string `yaml:"project"`
+	// APIEndpoint, if set, is queried as is for this prover's order instead
+	// of API_ENDPOINT?prover=<address>.
+	APIEndpoint string `yaml:"api_endpoint"`
+}
+
+type Config struct {
+	SSHUser          string        `yaml:"ssh_user"`
+	APIEndpoint      string        `yaml:"api_endpoint"`
+	APIBatchEndpoint string        `yaml:"api_batch_endpoint"`
+	APIToken         string        `yaml:"api_token"`
+	APITokenHeader   string        `yaml:"api_token_header"`
+	APIUserAgent     string        `yaml:"api_user_agent"`
+	APICACert        string        `yaml:"api_ca_cert"`
+	APIProxy         string        `yaml:"api_proxy_url"`
+	APIInsecure      bool          `yaml:"api_insecure_skip_verify"` // development only
+	PollInterval     time.Duration `yaml:"poll_interval"`
+	PollJitter       *float64      `yaml:"poll_jitter"`
+	SSHTimeout       time.Duration `yaml:"ssh_timeout"`
+	SSHRetries       int           `yaml:"ssh_retries"`
+	APITimeout       time.Duration `yaml:"api_timeout"`
+	APIRetries       int           `yaml:"api_retries"`
+	BreakerThreshold int           `yaml:"api_breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"api_breaker_cooldown"`
+	SwitchDebounce   int           `yaml:"switch_debounce"`
+	SwitchCooldown   time.Duration `yaml:"switch_cooldown"`
+	SwitchOrder      string        `yaml:"switch_order"`
+	SwitchDeadline   time.Duration `yaml:"switch_deadline"`
+	SwitchStagger    time.Duration `yaml:"switch_stagger"`
+	FallbackPolicy   string        `yaml:"fallback_policy"`
+	OrderSource      string        `yaml:"order_source"`
+	WarmStandby      bool          `yaml:"warm_standby"`
+	WarmServeAction  string        `yaml:"warm_standby_serve"`
+	WarmIdleAction   string        `yaml:"warm_standby_idle"`
+	SplitMinOrders   int           `yaml:"split_min_orders"`
+	SplitRatio       []float64     `yaml:"split_ratio"`
+	ForceSplit       bool          `yaml:"force_split"`
+	DisableSplit     bool          `yaml:"disable_split"`
+	ComposeCmd       string        `yaml:"compose_cmd"`
+	StatusPort       int           `yaml:"status_port"`
+	ControlToken     string        `yaml:"control_token"`
+	ControlRate      int           `yaml:"control_rate_limit"`
+	ControlBurst     int           `yaml:"control_burst"`
+	StateFile        string        `yaml:"state_file"`
+	SSHConcurrency   int           `yaml:"ssh_concurrency"`
+	SSHPasswordDir   string        `yaml:"ssh_password_dir"`
+	HostKeyPolicy    string        `yaml:"ssh_host_key_policy"`
+	KnownHostsFile   string        `yaml:"ssh_known_hosts"`
+	DryRun           bool          `yaml:"dry_run"`
+	Pprof            bool          `yaml:"pprof"`
+	FallbackProver   int           `yaml:"fallback_prover"`
+	WebhookURL       string        `yaml:"webhook_url"`
+	PostSwitchHook   string        `yaml:"post_switch_hook"`
+	HookTimeout      time.Duration `yaml:"post_switch_hook_timeout"`
+	HistorySize      int           `yaml:"history_size"`
+	Quarantined      []string      `yaml:"quarantined_clusters"`
+	IdleShutdown     time.Duration `yaml:"idle_shutdown"`
+	StopOnExit       bool          `yaml:"stop_on_exit"`
+	Maintenance      []string      `yaml:"maintenance_windows"`
+	HealthCheck      time.Duration `yaml:"health_check_interval"`
+	Reconcile        time.Duration `yaml:"reconcile_interval"`
+	StallTimeout     time.Duration `yaml:"stall_timeout"`
+	DrainTimeout     time.Duration `yaml:"drain_timeout"`
+	ServingProbeURL  string        `yaml:"serving_probe_url"`
+	ServingProbe     time.Duration `yaml:"serving_probe_timeout"`
+
+	Clusters []Cluster      `yaml:"clusters"`
+	Provers  []ProverConfig `yaml:"provers"`
+}
+
+func loadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := decodeConfig(path, data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	var bad []string
+	for i, c := range cfg.Clusters {
+		c.IP = unbracket(c.IP)
+		cfg.Clusters[i].IP = c.IP
+		switch {
+		case strings.TrimSpace(c.IP) == "":
+			bad = append(bad, fmt.Sprintf("clusters[%d]: ip is required", i))
+		case c.Password == "" && c.PasswordFile == "" && c.KeyPath == "" &&
+			cfg.SSHPasswordDir == "" && os.Getenv("SSH_PASSWORD_DIR") == "":
+			bad = append(bad, fmt.Sprintf("clusters[%d] (%s): password, password_file or key_path is required", i, c.IP))
+		case c.Password != "" && c.PasswordFile != "":
+			bad = append(bad, fmt.Sprintf("clusters[%d] (%s): password and password_file are mutually exclusive", i, c.IP))
+		case (c.Password != "" || c.PasswordFile != "") && c.KeyPath != "":
+			bad = append(bad, fmt.Sprintf("clusters[%d] (%s): password and key_path are mutually exclusive", i, c.IP))
+		default:
+			if err := validateClusterAddr(c); err != nil {
+				bad = append(bad, fmt.Sprintf("clusters[%d] (%s): %v", i, c.IP, err))
+			}
+		}
+	}
+	if len(bad) > 0 {
+		return nil, fmt.Errorf("invalid cluster entries in %s:\n  %s", path, strings.Join(bad, "\n  "))
+	}
+
+	return &cfg, nil
+}
+
+// unbracket strips the brackets from an IPv6 address written as "[addr]".
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// matchClusters returns the indexes of the clusters in cs that entry names:
+// every cluster on the host for "host", the one cluster for "host:port". It
+// takes the forms parseClusterAddr does.
+func matchClusters(cs []Cluster, entry string) []int {
+	want, err := parseClusterAddr(entry)
+	if err != nil {
+		return nil
+	}
+	var idx []int
+	for i, c := range cs {
+		if c.IP == want.IP && (want.Port == 0 || c.Port == want.Port) {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// parseClusterAddr accepts "host" or "host:port". IPv6 addresses are given
+// bare ("2001:db8::1") or bracketed ("[2001:db8::1]", "[2001:db8::1]:2222").
+func parseClusterAddr(entry string) (Cluster, error) {
+	host, portStr, err := net.SplitHostPort(entry)
+	if err != nil {
+		// No port given.
+		return Cluster{IP: unbracket(entry)}, nil
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return Cluster{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	return Cluster{IP: host, Port: port}, nil
+}
+
+// validateClusterAddr checks that the cluster address is an IP or a
+// resolvable hostname and that its port, if set, is in range.
+func validateClusterAddr(c Cluster) error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if net.ParseIP(c.IP) != nil {
+		return nil
+	}
+	if _, err := net.LookupHost(c.IP); err != nil {
+		return errors.New("not an IP address or resolvable hostname")
+	}
+	return nil
+}
+
+// validProject reports whether name is a valid docker compose project name.
+// Anything else compose rejects or lowers, which would let a prover's start
+// and stop name different projects.
+func validProject(name string) bool {
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case (r == '-' || r == '_') && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func splitList(s string) []string {
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// parsePasswords splits SSH_PASSWORDS. A JSON array of strings is taken as
+// is, so passwords may contain any character; anything else is split on delim
+// (a comma if empty) with surrounding spaces trimmed.
+func parsePasswords(s, delim string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		var list []string
+		if err := json.Unmarshal([]byte(s), &list); err != nil {
+			// Leave out err: it can quote part of a password.
+			return nil, errors.New("SSH_PASSWORDS: not a JSON array of strings")
+		}
+		return list, nil
+	}
+	if delim == "" {
+		delim = ","
+	}
+	list := strings.Split(s, delim)
+	for i := range list {
+		list[i] = strings.TrimSpace(list[i])
+	}
+	return list, nil
+}
+
+func envString(name string, dst *string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+func envDuration(name string, dst *time.Duration) error {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*dst = d
+	}
+	return nil
+}
+
+func envInt(name string, dst *int) error {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*dst = n
+	}
+	return nil
+}
+
+func envFloat(name string, dst **float64) error {
+	if v := os.Getenv(name); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*dst = &f
+	}
+	return nil
+}
+
+func envBool(name string, dst *bool) error {
+	if v := os.Getenv(name); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*dst = b
+	}
+	return nil
+}
+
+// applyEnv overlays environment variables on top of cfg so existing env-only
+// deployments keep working and individual settings can be overridden.
+func applyEnv(cfg *Config) error {
+	if ips := os.Getenv("CLUSTER_IPS"); ips != "" {
+		cfg.Clusters = nil
+		var bad []string
+		for _, entry := range splitList(ips) {
+			if entry == "" {
+				// Stray or trailing commas.
+				continue
+			}
+			c, err := parseClusterAddr(entry)
+			if err == nil {
+				err = validateClusterAddr(c)
+			}
+			if err != nil {
+				bad = append(bad, fmt.Sprintf("%s: %v", entry, err))
+				continue
+			}
+			cfg.Clusters = append(cfg.Clusters, c)
+		}
+		if len(bad) > 0 {
+			return fmt.Errorf("CLUSTER_IPS has invalid entries:\n  %s", strings.Join(bad, "\n  "))
+		}
+		if len(cfg.Clusters) == 0 {
+			return fmt.Errorf("CLUSTER_IPS is set but lists no clusters: %q", ips)
+		}
+	}
+
+	if passwords := os.Getenv("SSH_PASSWORDS"); passwords != "" {
+		passList, err := parsePasswords(passwords, os.Getenv("SSH_PASSWORD_DELIM"))
+		if err != nil {
+			return err
+		}
+		if len(passList) != len(cfg.Clusters) {
+			return fmt.Errorf("SSH_PASSWORDS has %d entries but there are %d clusters — must match", len(passList), len(cfg.Clusters))
+		}
+		for i, pass := range passList {
+			if pass != "" {
+				cfg.Clusters[i].Password = pass
+			}
+		}
+	}
+
+	if files := os.Getenv("SSH_PASSWORD_FILES"); files != "" {
+		fileList := splitList(files)
+		if len(fileList) != len(cfg.Clusters) {
+			return fmt.Errorf("SSH_PASSWORD_FILES has %d entries but there are %d clusters — must match", len(fileList), len(cfg.Clusters))
+		}
+		for i, file := range fileList {
+			if file != "" {
+				cfg.Clusters[i].PasswordFile = file
+			}
+		}
+	}
+	envString("SSH_PASSWORD_DIR", &cfg.SSHPasswordDir)
+	envString("SSH_HOST_KEY_POLICY", &cfg.HostKeyPolicy)
+	envString("SSH_KNOWN_HOSTS", &cfg.KnownHostsFile)
+
+	if keys := os.Getenv("SSH_KEYS"); keys != "" {
+		keyList := splitList(keys)
+		if len(keyList) != len(cfg.Clusters) {
+			return fmt.Errorf("SSH_KEYS has %d entries but there are %d clusters — must match", len(keyList), len(cfg.Clusters))
+		}
+		for i, key := range keyList {
+			if key != "" {
+				cfg.Clusters[i].KeyPath = key
+			}
+		}
+	}
+
+	if groups := os.Getenv("CLUSTER_GROUPS"); groups != "" {
+		groupList := splitList(groups)
+		if len(groupList) != len(cfg.Clusters) {
+			return fmt.Errorf("CLUSTER_GROUPS has %d entries but there are %d clusters — must match", len(groupList), len(cfg.Clusters))
+		}
+		for i, group := range groupList {
+			cfg.Clusters[i].Group = group
+		}
+	}
+
+	if weights := os.Getenv("CLUSTER_WEIGHTS"); weights != "" {
+		weightList := splitList(weights)
+		if len(weightList) != len(cfg.Clusters) {
+			return fmt.Errorf("CLUSTER_WEIGHTS has %d entries but there are %d clusters — must match", len(weightList), len(cfg.Clusters))
+		}
+		for i, weight := range weightList {
+			if weight == "" {
+				continue
+			}
+			n, err := strconv.Atoi(weight)
+			if err != nil {
+				return fmt.Errorf("CLUSTER_WEIGHTS: %v", err)
+			}
+			cfg.Clusters[i].Weight = n
+		}
+	}
+
+	if urls := os.Getenv("CLUSTER_DRAIN_URLS"); urls != "" {
+		urlList := splitList(urls)
+		if len(urlList) != len(cfg.Clusters) {
+			return fmt.Errorf("CLUSTER_DRAIN_URLS has %d entries but there are %d clusters — must match", len(urlList), len(cfg.Clusters))
+		}
+		for i, u := range urlList {
+			cfg.Clusters[i].DrainURL = u
+		}
+	}
+
+	envString("API_ENDPOINT", &cfg.APIEndpoint)
+	envString("API_BATCH_ENDPOINT", &cfg.APIBatchEndpoint)
+	envString("API_TOKEN", &cfg.APIToken)
+	envString("API_TOKEN_HEADER", &cfg.APITokenHeader)
+	envString("API_USER_AGENT", &cfg.APIUserAgent)
+	envString("API_CA_CERT", &cfg.APICACert)
+	envString("API_PROXY_URL", &cfg.APIProxy)
+	envString("SSH_USER", &cfg.SSHUser)
+	envString("STATE_FILE", &cfg.StateFile)
+	envString("WEBHOOK_URL", &cfg.WebhookURL)
+	envString("POST_SWITCH_HOOK", &cfg.PostSwitchHook)
+	envString("SERVING_PROBE_URL", &cfg.ServingProbeURL)
+	envString("CONTROL_TOKEN", &cfg.ControlToken)
+	envString("SWITCH_ORDER", &cfg.SwitchOrder)
+	envString("FALLBACK_POLICY", &cfg.FallbackPolicy)
+	envString("ORDER_SOURCE", &cfg.OrderSource)
+	envString("WARM_STANDBY_SERVE", &cfg.WarmServeAction)
+	envString("WARM_STANDBY_IDLE", &cfg.WarmIdleAction)
+	envString("DOCKER_COMPOSE_CMD", &cfg.ComposeCmd)
+	err := errors.Join(
+		envDuration("POLL_INTERVAL", &cfg.PollInterval),
+		envFloat("POLL_JITTER", &cfg.PollJitter),
+		envDuration("SSH_TIMEOUT", &cfg.SSHTimeout),
+		envInt("SSH_RETRIES", &cfg.SSHRetries),
+		envDuration("API_TIMEOUT", &cfg.APITimeout),
+		envInt("API_RETRIES", &cfg.APIRetries),
+		envInt("API_BREAKER_THRESHOLD", &cfg.BreakerThreshold),
+		envDuration("API_BREAKER_COOLDOWN", &cfg.BreakerCooldown),
+		envInt("SWITCH_DEBOUNCE", &cfg.SwitchDebounce),
+		envInt("SPLIT_MIN_ORDERS", &cfg.SplitMinOrders),
+		envDuration("SWITCH_COOLDOWN", &cfg.SwitchCooldown),
+		envInt("STATUS_PORT", &cfg.StatusPort),
+		envInt("CONTROL_RATE_LIMIT", &cfg.ControlRate),
+		envInt("CONTROL_BURST", &cfg.ControlBurst),
+		envInt("SSH_CONCURRENCY", &cfg.SSHConcurrency),
+		envBool("DRY_RUN", &cfg.DryRun),
+		envBool("PPROF", &cfg.Pprof),
+		envBool("WARM_STANDBY", &cfg.WarmStandby),
+		envBool("STOP_ON_EXIT", &cfg.StopOnExit),
+		envBool("FORCE_SPLIT", &cfg.ForceSplit),
+		envBool("DISABLE_SPLIT", &cfg.DisableSplit),
+		envBool("API_INSECURE_SKIP_VERIFY", &cfg.APIInsecure),
+		envInt("FALLBACK_PROVER", &cfg.FallbackProver),
+		envInt("HISTORY_SIZE", &cfg.HistorySize),
+		envDuration("IDLE_SHUTDOWN", &cfg.IdleShutdown),
+		envDuration("HEALTH_CHECK_INTERVAL", &cfg.HealthCheck),
+		envDuration("RECONCILE_INTERVAL", &cfg.Reconcile),
+		envDuration("STALL_TIMEOUT", &cfg.StallTimeout),
+		envDuration("DRAIN_TIMEOUT", &cfg.DrainTimeout),
+		envDuration("SERVING_PROBE_TIMEOUT", &cfg.ServingProbe),
+		envDuration("SWITCH_DEADLINE", &cfg.SwitchDeadline),
+		envDuration("SWITCH_STAGGER", &cfg.SwitchStagger),
+		envDuration("POST_SWITCH_HOOK_TIMEOUT", &cfg.HookTimeout),
+	)
+	if err != nil {
+		return err
+	}
+
+	if addrs := os.Getenv("PROVER_ADDRESSES"); addrs != "" {
+		addrList := splitList(addrs)
+		provers := make([]ProverConfig, len(addrList))
+		for i, addr := range addrList {
+			provers[i].Address = addr
+			if i < len(cfg.Provers) {
+				provers[i].Folder = cfg.Provers[i].Folder
+				provers[i].ComposeFile = cfg.Provers[i].ComposeFile
+				provers[i].Project = cfg.Provers[i].Project
+				provers[i].APIEndpoint = cfg.Provers[i].APIEndpoint
+			}
+		}
+		cfg.Provers = provers
+	} else if len(cfg.Provers) == 0 {
+		// Legacy two-prover configuration.
+		cfg.Provers = []ProverConfig{
+			{Address: os.Getenv("PROVER1_ADDRESS")},
+			{Address: os.Getenv("PROVER2_ADDRESS")},
+		}
+	}
+
+	if ratio := os.Getenv("SPLIT_RATIO"); ratio != "" {
+		cfg.SplitRatio = nil
+		parts := splitList(ratio)
+		if strings.Contains(ratio, ":") {
+			parts = strings.Split(ratio, ":")
+		}
+		for _, part := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return fmt.Errorf("SPLIT_RATIO: %v", err)
+			}
+			cfg.SplitRatio = append(cfg.SplitRatio, n)
+		}
+	}
+
+	if windows := os.Getenv("MAINTENANCE_WINDOWS"); windows != "" {
+		cfg.Maintenance = splitList(windows)
+	}
+
+	if ips := os.Getenv("QUARANTINED_CLUSTERS"); ips != "" {
+		cfg.Quarantined = splitList(ips)
+	}
+
+	if folders := os.Getenv("PROVER_FOLDERS"); folders != "" {
+		folderList := splitList(folders)
+		if len(folderList) != len(cfg.Provers) {
+			return fmt.Errorf("PROVER_FOLDERS has %d entries but there are %d prover addresses — must match", len(folderList), len(cfg.Provers))
+		}
+		for i := range cfg.Provers {
+			cfg.Provers[i].Folder = folderList[i]
+		}
+	}
+
+	if files := os.Getenv("PROVER_COMPOSE_FILES"); files != "" {
+		fileList := splitList(files)
+		if len(fileList) != len(cfg.Provers) {
+			return fmt.Errorf("PROVER_COMPOSE_FILES has %d entries but there are %d prover addresses — must match", len(fileList), len(cfg.Provers))
+		}
+		for i := range cfg.Provers {
+			cfg.Provers[i].ComposeFile = fileList[i]
+		}
+	}
+
+	if projects := os.Getenv("PROVER_PROJECTS"); projects != "" {
+		projectList := splitList(projects)
+		if len(projectList) != len(cfg.Provers) {
+			return fmt.Errorf("PROVER_PROJECTS has %d entries but there are %d prover addresses — must match", len(projectList), len(cfg.Provers))
+		}
+		for i := range cfg.Provers {
+			cfg.Provers[i].Project = projectList[i]
+		}
+	}
+
+	if endpoints := os.Getenv("PROVER_API_ENDPOINTS"); endpoints != "" {
+		endpointList := splitList(endpoints)
+		if len(endpointList) != len(cfg.Provers) {
+			return fmt.Errorf("PROVER_API_ENDPOINTS has %d entries but there are %d prover addresses — must match", len(endpointList), len(cfg.Provers))
+		}
+		for i := range cfg.Provers {
+			cfg.Provers[i].APIEndpoint = endpointList[i]
+		}
+	}
+	return nil
+}
+
+// readPasswordFiles fills in the password of every cluster with a
+// password_file, and of clusters without credentials that have a file named
+// after their IP in SSHPasswordDir.
+func readPasswordFiles(cfg *Config) error {
+	var bad []string
+	for i := range cfg.Clusters {
+		c := &cfg.Clusters[i]
+		if c.PasswordFile == "" && c.Password == "" && c.KeyPath == "" && cfg.SSHPasswordDir != "" {
+			path := filepath.Join(expandHome(cfg.SSHPasswordDir), c.IP)
+			if _, err := os.Stat(path); err == nil {
+				c.PasswordFile = path
+			}
+		}
+		if c.PasswordFile == "" {
+			continue
+		}
+		if c.Password != "" {
+			bad = append(bad, fmt.Sprintf("%s: both a password and a password file", c.IP))
+			continue
+		}
+
+		data, err := os.ReadFile(expandHome(c.PasswordFile))
+		if err != nil {
+			bad = append(bad, fmt.Sprintf("%s: %v", c.IP, err))
+			continue
+		}
+		c.Password = strings.TrimRight(string(data), "\r\n")
+		if c.Password == "" {
+			bad = append(bad, fmt.Sprintf("%s: password file %s is empty", c.IP, c.PasswordFile))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("cannot read SSH passwords:\n  %s", strings.Join(bad, "\n  "))
+	}
+	return nil
+}
+
+// apiEndpoints returns the order API endpoints in API_ENDPOINT, a
+// comma-separated list in priority order.
+func (cfg *Config) apiEndpoints() []string {
+	var endpoints []string
+	for _, e := range splitList(cfg.APIEndpoint) {
+		if e != "" {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// quarantinedKeys returns the clusterKey of every cluster QUARANTINED_CLUSTERS
+// names.
+func (cfg *Config) quarantinedKeys() []string {
+	var keys []string
+	for _, entry := range cfg.Quarantined {
+		for _, i := range matchClusters(cfg.Clusters, entry) {
+			keys = append(keys, clusterKey(cfg.Clusters[i]))
+		}
+	}
+	return keys
+}
+
+// maxPollDuration is the longest a poll can spend on the order API: every
+// attempt timing out, with the longest backoffs between them, at the batch
+// endpoint and then at each of the API endpoints in turn.
+func maxPollDuration(cfg *Config) time.Duration {
+	perEndpoint := time.Duration(cfg.APIRetries) * cfg.APITimeout
+	for attempt := 1; attempt < cfg.APIRetries; attempt++ {
+		perEndpoint += 2 * apiRetryBaseDelay << (attempt - 1)
+	}
+	endpoints := len(cfg.apiEndpoints())
+	if cfg.APIBatchEndpoint != "" {
+		endpoints++
+	}
+	return time.Duration(endpoints) * perEndpoint
+}
+
+// setProverEndpoints replaces proverAPIEndpoints with the provers' own
+// endpoints in cfg.
+func setProverEndpoints(cfg *Config) {
+	clear(proverAPIEndpoints)
+	for _, p := range cfg.Provers {
+		if p.APIEndpoint != "" {
+			proverAPIEndpoints[p.Address] = p.APIEndpoint
+		}
+	}
+}
+
+// loadConfig reads the config file, if any, overlays the environment and
+// returns the validated config with defaults filled in.
+func loadConfig(configPath string) (*Config, error) {
+	var cfg Config
+	if configPath != "" {
+		c, err := loadConfigFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("load config: %w", err)
+		}
+		cfg = *c
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Clusters) == 0 {
+		return nil, errors.New("no clusters configured (set CLUSTER_IPS or clusters in the config file)")
+	}
+	if len(cfg.apiEndpoints()) == 0 {
+		return nil, errors.New("API_ENDPOINT must be set")
+	}
+	if slices.ContainsFunc(cfg.Provers, func(p ProverConfig) bool { return p.Address == "" }) {
+		return nil, errors.New("PROVER_ADDRESSES (or PROVER1_ADDRESS and PROVER2_ADDRESS) must be set")
+	}
+
+	if err := readPasswordFiles(&cfg); err != nil {
+		return nil, err
+	}
+
+	var bothAuth []string
+	for _, c := range cfg.Clusters {
+		if c.Password != "" && c.KeyPath != "" {
+			bothAuth = append(bothAuth, c.IP)
+		}
+	}
+	if len(bothAuth) > 0 {
+		return nil, fmt.Errorf("clusters %s have both a password and an SSH key — use exactly one", strings.Join(bothAuth, ", "))
+	}
+
+	var badFolders, badFiles []string
+	for i := range cfg.Clusters {
+		if cfg.Clusters[i].Port == 0 {
+			cfg.Clusters[i].Port = defaultSSHPort
+		}
+		switch w := cfg.Clusters[i].Weight; {
+		case w < 0:
+			return nil, fmt.Errorf("cluster %s: weight must not be negative, got %d", cfg.Clusters[i].IP, w)
+		case w == 0:
+			cfg.Clusters[i].Weight = 1
+		}
+		for id, folder := range cfg.Clusters[i].Folders {
+			if id < 1 || id > len(cfg.Provers) || folder == "" {
+				badFolders = append(badFolders, fmt.Sprintf("%s: %d: %q", cfg.Clusters[i].IP, id, folder))
+			}
+		}
+		for id, file := range cfg.Clusters[i].ComposeFiles {
+			if id < 1 || id > len(cfg.Provers) || file == "" {
+				badFiles = append(badFiles, fmt.Sprintf("%s: %d: %q", cfg.Clusters[i].IP, id, file))
+			}
+		}
+	}
+	if len(badFolders) > 0 {
+		slices.Sort(badFolders)
+		return nil, fmt.Errorf("cluster folder overrides must name a configured prover (1-%d) and a folder: %s",
+			len(cfg.Provers), strings.Join(badFolders, ", "))
+	}
+	if len(badFiles) > 0 {
+		slices.Sort(badFiles)
+		return nil, fmt.Errorf("cluster compose file overrides must name a configured prover (1-%d) and a file: %s",
+			len(cfg.Provers), strings.Join(badFiles, ", "))
+	}
+
+	var unknown []string
+	for _, entry := range cfg.Quarantined {
+		if len(matchClusters(cfg.Clusters, entry)) == 0 {
+			unknown = append(unknown, entry)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("QUARANTINED_CLUSTERS names unconfigured clusters: %s", strings.Join(unknown, ", "))
+	}
+
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.PollInterval < minPollInterval {
+		return nil, fmt.Errorf("poll interval %s is below the %s minimum", cfg.PollInterval, minPollInterval)
+	}
+	if cfg.PollJitter == nil {
+		jitter := defaultPollJitter
+		cfg.PollJitter = &jitter
+	}
+	if *cfg.PollJitter < 0 || *cfg.PollJitter >= 1 {
+		return nil, fmt.Errorf("POLL_JITTER must be at least 0 and below 1, got %g", *cfg.PollJitter)
+	}
+
+	if cfg.SSHTimeout == 0 {
+		cfg.SSHTimeout = defaultSSHTimeout
+	}
+	switch cfg.HostKeyPolicy {
+	case "", hostKeyNo, hostKeyAcceptNew, hostKeyYes:
+	default:
+		return nil, fmt.Errorf("SSH_HOST_KEY_POLICY must be %s, %s or %s, got %q",
+			hostKeyNo, hostKeyAcceptNew, hostKeyYes, cfg.HostKeyPolicy)
+	}
+	if cfg.KnownHostsFile == "" {
+		cfg.KnownHostsFile = defaultKnownHosts
+	}
+	if cfg.SSHRetries == 0 {
+		cfg.SSHRetries = defaultSSHRetries
+	}
+	if cfg.SSHRetries < 0 {
+		return nil, fmt.Errorf("SSH_RETRIES must be positive, got %d", cfg.SSHRetries)
+	}
+	if cfg.APITimeout == 0 {
+		cfg.APITimeout = defaultAPITimeout
+	}
+	if _, err := newAPIClient(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.APIRetries == 0 {
+		cfg.APIRetries = defaultAPIRetries
+	}
+	if cfg.APIRetries < 0 {
+		return nil, fmt.Errorf("API_RETRIES must be positive, got %d", cfg.APIRetries)
+	}
+	if cfg.BreakerThreshold < 0 {
+		return nil, fmt.Errorf("API_BREAKER_THRESHOLD must not be negative, got %d", cfg.BreakerThreshold)
+	}
+	if cfg.BreakerCooldown == 0 {
+		cfg.BreakerCooldown = defaultBreakerWait
+	}
+	if cfg.BreakerCooldown < 0 {
+		return nil, fmt.Errorf("API_BREAKER_COOLDOWN must be positive, got %s", cfg.BreakerCooldown)
+	}
+	if cfg.SwitchDebounce == 0 {
+		cfg.SwitchDebounce = defaultDebounce
+	}
+	if cfg.SwitchDebounce < 0 {
+		return nil, fmt.Errorf("SWITCH_DEBOUNCE must be positive, got %d", cfg.SwitchDebounce)
+	}
+	if cfg.SplitMinOrders < 0 {
+		return nil, fmt.Errorf("SPLIT_MIN_ORDERS must not be negative, got %d", cfg.SplitMinOrders)
+	}
+	if len(cfg.SplitRatio) > 0 {
+		if len(cfg.SplitRatio) != len(cfg.Provers) {
+			return nil, fmt.Errorf("SPLIT_RATIO has %d entries but there are %d provers — must match", len(cfg.SplitRatio), len(cfg.Provers))
+		}
+		if slices.ContainsFunc(cfg.SplitRatio, func(n float64) bool { return !(n > 0) || n > maxSplitRatio }) {
+			return nil, fmt.Errorf("SPLIT_RATIO entries must be positive and at most %g, got %s", float64(maxSplitRatio), formatRatio(cfg.SplitRatio))
+		}
+	}
+	if cfg.ForceSplit && len(cfg.Provers) < 2 {
+		return nil, fmt.Errorf("FORCE_SPLIT needs at least 2 provers, got %d", len(cfg.Provers))
+	}
+	if cfg.DisableSplit && (cfg.ForceSplit || len(cfg.SplitRatio) > 0) {
+		return nil, errors.New("DISABLE_SPLIT can't be combined with FORCE_SPLIT or SPLIT_RATIO")
+	}
+	if cfg.SwitchCooldown == 0 {
+		cfg.SwitchCooldown = defaultCooldown
+	}
+	switch cfg.SwitchOrder {
+	case "":
+		cfg.SwitchOrder = switchStopFirst
+	case switchStopFirst, switchStartFirst:
+	default:
+		return nil, fmt.Errorf("SWITCH_ORDER must be %s or %s, got %q", switchStopFirst, switchStartFirst, cfg.SwitchOrder)
+	}
+	if cfg.WarmServeAction == "" {
+		cfg.WarmServeAction = defaultServeAction
+	}
+	if cfg.WarmIdleAction == "" {
+		cfg.WarmIdleAction = defaultIdleAction
+	}
+	switch cfg.FallbackPolicy {
+	case "":
+		cfg.FallbackPolicy = fallbackAllFailed
+	case fallbackAllFailed, fallbackAnyFailed:
+	default:
+		return nil, fmt.Errorf("FALLBACK_POLICY must be %s or %s, got %q", fallbackAllFailed, fallbackAnyFailed, cfg.FallbackPolicy)
+	}
+	switch cfg.OrderSource {
+	case "":
+		cfg.OrderSource = orderSourceProver
+	case orderSourceProver:
+	case orderSourceGroup:
+		for i, c := range cfg.Clusters {
+			if c.Group == "" {
+				return nil, fmt.Errorf("ORDER_SOURCE=group needs a group on every cluster, cluster %d (%s) has none", i, c.IP)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("ORDER_SOURCE must be %s or %s, got %q", orderSourceProver, orderSourceGroup, cfg.OrderSource)
+	}
+	if cfg.ComposeCmd == "" {
+		cfg.ComposeCmd = defaultComposeCmd
+	}
+	if _, err := parseMaintenanceWindows(cfg.Maintenance); err != nil {
+		return nil, err
+	}
+	if cfg.IdleShutdown < 0 {
+		return nil, fmt.Errorf("IDLE_SHUTDOWN must not be negative, got %s", cfg.IdleShutdown)
+	}
+	if cfg.HealthCheck < 0 {
+		return nil, fmt.Errorf("HEALTH_CHECK_INTERVAL must not be negative, got %s", cfg.HealthCheck)
+	}
+	switch {
+	case cfg.Reconcile < 0:
+		return nil, fmt.Errorf("RECONCILE_INTERVAL must not be negative, got %s", cfg.Reconcile)
+	case cfg.Reconcile == 0:
+		cfg.Reconcile = defaultReconcile
+	}
+	if cfg.SwitchDeadline < 0 {
+		return nil, fmt.Errorf("SWITCH_DEADLINE must not be negative, got %s", cfg.SwitchDeadline)
+	}
+	if cfg.SwitchStagger < 0 {
+		return nil, fmt.Errorf("SWITCH_STAGGER must not be negative, got %s", cfg.SwitchStagger)
+	}
+	if cfg.DrainTimeout < 0 {
+		return nil, fmt.Errorf("DRAIN_TIMEOUT must not be negative, got %s", cfg.DrainTimeout)
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+	if cfg.ServingProbeURL != "" {
+		if u, err := url.Parse(cfg.ServingProbeURL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("SERVING_PROBE_URL: not a URL: %q", cfg.ServingProbeURL)
+		}
+	}
+	if cfg.ServingProbe < 0 {
+		return nil, fmt.Errorf("SERVING_PROBE_TIMEOUT must not be negative, got %s", cfg.ServingProbe)
+	}
+	if cfg.ServingProbe == 0 {
+		cfg.ServingProbe = defaultProbeTimeout
+	}
+	// The wait between two polls can reach the interval plus jitter, and a
+	// poll can then spend its longest on the order API before switching for
+	// up to SWITCH_DEADLINE and probing the new provers. Without a deadline a
+	// switch to an unreachable cluster or through a long drain has no bound,
+	// and the watchdog would kill it midway.
+	if cfg.StallTimeout != 0 {
+		maxWait := time.Duration(float64(cfg.PollInterval)*(1+*cfg.PollJitter)) + maxPollDuration(&cfg) + cfg.SwitchDeadline
+		if cfg.ServingProbeURL != "" {
+			maxWait += cfg.ServingProbe
+		}
+		switch {
+		case cfg.SwitchDeadline == 0:
+			return nil, errors.New("STALL_TIMEOUT requires SWITCH_DEADLINE, so a slow switch isn't taken for a stall")
+		case cfg.StallTimeout <= maxWait:
+			return nil, fmt.Errorf("STALL_TIMEOUT must be 0 or longer than the poll interval with jitter, the longest order poll, SWITCH_DEADLINE and SERVING_PROBE_TIMEOUT together (%s), got %s", maxWait, cfg.StallTimeout)
+		}
+	}
+	if cfg.HookTimeout < 0 {
+		return nil, fmt.Errorf("POST_SWITCH_HOOK_TIMEOUT must not be negative, got %s", cfg.HookTimeout)
+	}
+	if cfg.HookTimeout == 0 {
+		cfg.HookTimeout = defaultHookTimeout
+	}
+	if cfg.HistorySize == 0 {
+		cfg.HistorySize = defaultHistorySize
+	}
+	if cfg.HistorySize < 0 {
+		return nil, fmt.Errorf("HISTORY_SIZE must be positive, got %d", cfg.HistorySize)
+	}
+	if cfg.StatusPort == 0 {
+		cfg.StatusPort = defaultStatusPort
+	}
+	if cfg.ControlRate == 0 {
+		cfg.ControlRate = defaultControlRate
+	}
+	if cfg.ControlRate < 0 {
+		return nil, fmt.Errorf("CONTROL_RATE_LIMIT must be positive, got %d", cfg.ControlRate)
+	}
+	if cfg.ControlBurst == 0 {
+		cfg.ControlBurst = defaultControlBurst
+	}
+	if cfg.ControlBurst < 0 {
+		return nil, fmt.Errorf("CONTROL_BURST must be positive, got %d", cfg.ControlBurst)
+	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = defaultStateFile
+	}
+	if cfg.SSHConcurrency == 0 {
+		cfg.SSHConcurrency = defaultConcurrency
+	}
+	if cfg.SSHConcurrency < 0 {
+		return nil, fmt.Errorf("SSH_CONCURRENCY must be positive, got %d", cfg.SSHConcurrency)
+	}
+
+	if cfg.FallbackProver == 0 {
+		cfg.FallbackProver = defaultFallback
+	}
+	if cfg.FallbackProver < 1 || cfg.FallbackProver > len(cfg.Provers) {
+		return nil, fmt.Errorf("FALLBACK_PROVER %d is not a configured prover (1-%d)", cfg.FallbackProver, len(cfg.Provers))
+	}
+
+	projects := map[string]int{}
+	for i := range cfg.Provers {
+		if cfg.Provers[i].Folder == "" {
+			cfg.Provers[i].Folder = fmt.Sprintf("~/prover-%d-aux-cluster", i+1)
+		}
+		p := cfg.Provers[i].Project
+		if p == "" {
+			continue
+		}
+		if !validProject(p) {
+			return nil, fmt.Errorf("prover %d: project %q must be lowercase letters, digits, dashes and underscores, starting with a letter or digit", i+1, p)
+		}
+		if other, ok := projects[p]; ok {
+			return nil, fmt.Errorf("provers %d and %d both use project %q", other, i+1, p)
+		}
+		projects[p] = i + 1
+	}
+	if cfg.APIUserAgent == "" {
+		cfg.APIUserAgent = "succinct-multi-prover-bidder/" + version
+	}
+	if cfg.APITokenHeader == "" {
+		cfg.APITokenHeader = "Authorization"
+	}
+	if cfg.SSHUser == "" {
+		cfg.SSHUser = "user01"
+	}
+	return &cfg, nil
+}
+
+// loadEnv loads the config and installs it in the package globals.
+func loadEnv(configPath string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	clusters = cfg.Clusters
+	clusterProvers = make([]int, len(clusters))
+	apiEndpoints = cfg.apiEndpoints()
+	preferredEndpoint.Store(0)
+	apiBatchEndpoint = cfg.APIBatchEndpoint
+	apiToken = cfg.APIToken
+	apiTokenHeader = cfg.APITokenHeader
+	apiUserAgent = cfg.APIUserAgent
+	pollInterval = cfg.PollInterval
+	pollJitter = *cfg.PollJitter
+	sshTimeout = cfg.SSHTimeout
+	sshRetries = cfg.SSHRetries
+	hostKeyPolicy = cfg.HostKeyPolicy
+	knownHostsFile = cfg.KnownHostsFile
+	if cfg.HostKeyPolicy == hostKeyNo {
+		slog.Warn("SSH_HOST_KEY_POLICY=no: cluster host keys are NOT verified")
+	}
+	if apiClient, err = newAPIClient(cfg); err != nil {
+		return err
+	}
+	if os.Getenv("SSH_PASSWORDS") != "" {
+		slog.Warn("SSH_PASSWORDS exposes passwords in the process environment, prefer SSH_PASSWORD_DIR or SSH_PASSWORD_FILES")
+	}
+	slog.Info("Order API proxy", "proxy", effectiveProxy(apiClient, apiEndpoints[0]))
+	if cfg.APIInsecure {
+		slog.Warn("API_INSECURE_SKIP_VERIFY is set: order API certificates are NOT verified. Never use this in production")
+	}
+	apiRetries = cfg.APIRetries
+	breakerThreshold = cfg.BreakerThreshold
+	breakerCooldown = cfg.BreakerCooldown
+	switchDebounce = cfg.SwitchDebounce
+	switchCooldown = cfg.SwitchCooldown
+	switchOrder = cfg.SwitchOrder
+	switchDeadline = cfg.SwitchDeadline
+	switchStagger = cfg.SwitchStagger
+	fallbackPolicy = cfg.FallbackPolicy
+	orderSourceMode = cfg.OrderSource
+	warmStandby = cfg.WarmStandby
+	warmServeAction = cfg.WarmServeAction
+	warmIdleAction = cfg.WarmIdleAction
+	splitMinOrders = cfg.SplitMinOrders
+	splitRatio = ratioWeights(cfg.SplitRatio)
+	forceSplit = cfg.ForceSplit
+	disableSplit = cfg.DisableSplit
+	composeCmd = cfg.ComposeCmd
+	statusPort = cfg.StatusPort
+	controlToken = cfg.ControlToken
+	controlLimiter = newTokenBucket(cfg.ControlRate, cfg.ControlBurst)
+	stateFile = cfg.StateFile
+	sshSem = make(chan struct{}, cfg.SSHConcurrency)
+	dryRun = cfg.DryRun
+	pprofEnabled = cfg.Pprof
+	fallbackProver = cfg.FallbackProver
+	webhookURL = cfg.WebhookURL
+	postSwitchHook = cfg.PostSwitchHook
+	postSwitchHookTimeout = cfg.HookTimeout
+	historySize = cfg.HistorySize
+	idleShutdown = cfg.IdleShutdown
+	stopOnExit = cfg.StopOnExit
+	if maintenanceWindows, err = parseMaintenanceWindows(cfg.Maintenance); err != nil {
+		return err
+	}
+	healthCheckInterval = cfg.HealthCheck
+	reconcileInterval = cfg.Reconcile
+	stallTimeout = cfg.StallTimeout
+	drainTimeout = cfg.DrainTimeout
+	servingProbeURL = cfg.ServingProbeURL
+	servingProbeTimeout = cfg.ServingProbe
+	sshUser = cfg.SSHUser
+	for _, key := range cfg.quarantinedKeys() {
+		quarantined[key] = true
+	}
+	if len(cfg.Quarantined) > 0 {
+		slog.Warn("Clusters quarantined, switches will skip them", "clusters", cfg.Quarantined)
+	}
+
+	for i, p := range cfg.Provers {
+		id := i + 1
+		proverAddresses[id] = p.Address
+		proverFolders[id] = p.Folder
+		proverComposeFiles[id] = p.ComposeFile
+		proverProjects[id] = p.Project
+	}
+	setProverEndpoints(cfg)
+	return nil
+}
+
+// ratioWeights turns split ratios into the whole-number weights
+// allocateClusters divides by, keeping six decimal places so fractional ratios
+// such as 1.5:1 are honoured.
+func ratioWeights(ratio []float64) []int {
+	if len(ratio) == 0 {
+		return nil
+	}
+	weights := make([]int, len(ratio))
+	for i, r := range ratio {
+		weights[i] = max(int(math.Round(r*1e6)), 1)
+	}
+	return weights
+}
+
+// formatRatio writes ratio the way SPLIT_RATIO accepts it, such as "2:1:1".
+func formatRatio(ratio []float64) string {
+	parts := make([]string, len(ratio))
+	for i, r := range ratio {
+		parts[i] = strconv.FormatFloat(r, 'g', -1, 64)
+	}
+	return strings.Join(parts, ":")
+}
+
+// configJSON returns cfg as a value that encodes to JSON keyed like the config
+// file, with secrets replaced by "redacted".
+func configJSON(cfg *Config) (any, error) {
+	redacted := *cfg
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "redacted"
+		}
+	}
+	redact(&redacted.APIToken)
+	redact(&redacted.ControlToken)
+	if proxy, err := url.Parse(redacted.APIProxy); err == nil {
+		redacted.APIProxy = proxy.Redacted()
+	}
+	redacted.Clusters = slices.Clone(cfg.Clusters)
+	for i := range redacted.Clusters {
+		redact(&redacted.Clusters[i].Password)
+	}
+
+	// Go through YAML so the keys and durations match the config file.
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return jsonValue(v), nil
+}
+
+// jsonValue converts the maps yaml.v3 decodes non-string keys into, such as
+// the prover IDs of cluster folders, into maps encoding/json accepts.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// printConfig writes a normalized summary of cfg, leaving out secrets.
+func printConfig(w io.Writer, cfg *Config) {
+	for i, endpoint := range cfg.apiEndpoints() {
+		if i == 0 {
+			fmt.Fprintf(w, "api endpoint:     %s\n", endpoint)
+		} else {
+			fmt.Fprintf(w, "  failover %d:     %s\n", i, endpoint)
+		}
+	}
+	if cfg.APIBatchEndpoint != "" {
+		fmt.Fprintf(w, "batch endpoint:   %s\n", cfg.APIBatchEndpoint)
+	}
+	if cfg.APIToken != "" {
+		fmt.Fprintf(w, "api token:        set (%s header)\n", cfg.APITokenHeader)
+	}
+	fmt.Fprintf(w, "api user agent:   %s\n", cfg.APIUserAgent)
+	if cfg.APICACert != "" {
+		fmt.Fprintf(w, "api ca cert:      %s\n", cfg.APICACert)
+	}
+	if client, err := newAPIClient(cfg); err == nil {
+		fmt.Fprintf(w, "api proxy:        %s\n", effectiveProxy(client, cfg.apiEndpoints()[0]))
+	}
+	if cfg.APIInsecure {
+		fmt.Fprintln(w, "api tls:          NOT VERIFIED (api_insecure_skip_verify)")
+	}
+	fmt.Fprintf(w, "poll interval:    %s ±%g%%\n", cfg.PollInterval, *cfg.PollJitter*100)
+	fmt.Fprintf(w, "api timeout:      %s, %d attempts\n", cfg.APITimeout, cfg.APIRetries)
+	if cfg.BreakerThreshold > 0 {
+		fmt.Fprintf(w, "api breaker:      open after %d failed polls for %s\n", cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	fmt.Fprintf(w, "ssh timeout:      %s, %d attempts, %d concurrent\n", cfg.SSHTimeout, cfg.SSHRetries, cfg.SSHConcurrency)
+	if cfg.HostKeyPolicy == "" {
+		fmt.Fprintf(w, "ssh host keys:    unchecked for password clusters, %s for others\n", cfg.KnownHostsFile)
+	} else {
+		fmt.Fprintf(w, "ssh host keys:    %s (%s)\n", cfg.HostKeyPolicy, cfg.KnownHostsFile)
+	}
+	fmt.Fprintf(w, "switch debounce:  %d polls, %s cooldown\n", cfg.SwitchDebounce, cfg.SwitchCooldown)
+	fmt.Fprintf(w, "switch order:     %s\n", cfg.SwitchOrder)
+	if cfg.SwitchDeadline > 0 {
+		fmt.Fprintf(w, "switch deadline:  %s\n", cfg.SwitchDeadline)
+	}
+	if cfg.SwitchStagger > 0 {
+		fmt.Fprintf(w, "switch stagger:   %s between cluster starts\n", cfg.SwitchStagger)
+	}
+	if cfg.WarmStandby {
+		fmt.Fprintf(w, "warm standby:     serve with %q, park with %q\n", cfg.WarmServeAction, cfg.WarmIdleAction)
+	}
+	if cfg.SplitMinOrders > 0 {
+		fmt.Fprintf(w, "split min orders: %d\n", cfg.SplitMinOrders)
+	}
+	if len(cfg.SplitRatio) > 0 {
+		fmt.Fprintf(w, "split ratio:      %s\n", formatRatio(cfg.SplitRatio))
+	}
+	if cfg.ForceSplit {
+		fmt.Fprintln(w, "force split:      yes (orders ignored)")
+	}
+	if cfg.DisableSplit {
+		fmt.Fprintln(w, "split:            disabled (highest priority, then most orders)")
+	}
+	fmt.Fprintf(w, "compose command:  %s\n", cfg.ComposeCmd)
+	fmt.Fprintf(w, "fallback prover:  %d (%s)\n", cfg.FallbackProver, cfg.FallbackPolicy)
+	if cfg.OrderSource == orderSourceGroup {
+		fmt.Fprintln(w, "order source:     per cluster group")
+	}
+	if cfg.IdleShutdown > 0 {
+		fmt.Fprintf(w, "idle shutdown:    %s\n", cfg.IdleShutdown)
+	}
+	if cfg.StopOnExit {
+		fmt.Fprintln(w, "stop on exit:     yes")
+	}
+	if len(cfg.Maintenance) > 0 {
+		fmt.Fprintf(w, "maintenance:      %s (UTC)\n", strings.Join(cfg.Maintenance, ", "))
+	}
+	if cfg.HealthCheck > 0 {
+		fmt.Fprintf(w, "health check:     every %s\n", cfg.HealthCheck)
+	}
+	fmt.Fprintf(w, "reconcile:        every %s\n", cfg.Reconcile)
+	if cfg.StallTimeout > 0 {
+		fmt.Fprintf(w, "stall timeout:    exit after %s without a poll\n", cfg.StallTimeout)
+	}
+	fmt.Fprintf(w, "status port:      %d\n", cfg.StatusPort)
+	access := "open"
+	if cfg.ControlToken != "" {
+		access = "bearer token"
+	}
+	fmt.Fprintf(w, "control api:      %s, %d/min, burst %d\n", access, cfg.ControlRate, cfg.ControlBurst)
+	fmt.Fprintf(w, "state file:       %s\n", cfg.StateFile)
+	if cfg.WebhookURL != "" {
+		fmt.Fprintf(w, "webhook:          %s\n", cfg.WebhookURL)
+	}
+	if cfg.PostSwitchHook != "" {
+		fmt.Fprintf(w, "post-switch hook: %s (timeout %s)\n", cfg.PostSwitchHook, cfg.HookTimeout)
+	}
+	if cfg.ServingProbeURL != "" {
+		fmt.Fprintf(w, "serving probe:    %s (timeout %s)\n", cfg.ServingProbeURL, cfg.ServingProbe)
+	}
+	if len(cfg.Quarantined) > 0 {
+		fmt.Fprintf(w, "quarantined:      %s\n", strings.Join(cfg.Quarantined, ", "))
+	}
+	if cfg.DryRun {
+		fmt.Fprintln(w, "dry run:          yes")
+	}
+	if cfg.Pprof {
+		fmt.Fprintln(w, "pprof:            /debug/pprof/")
+	}
+
+	fmt.Fprintf(w, "clusters (%d):\n", len(cfg.Clusters))
+	for i, c := range cfg.Clusters {
+		user := c.User
+		if user == "" {
+			user = cfg.SSHUser
+		}
+		auth := "ssh-agent or default keys"
+		switch {
+		case c.PasswordFile != "":
+			auth = "password from " + c.PasswordFile
+		case c.Password != "":
+			auth = "password"
+		case c.KeyPath != "":
+			auth = "key " + c.KeyPath
+		}
+		fmt.Fprintf(w, "  %d. %s@%s (%s)\n", i, user, clusterKey(c), auth)
+		if c.Group != "" {
+			fmt.Fprintf(w, "       group %s\n", c.Group)
+		}
+		if c.Weight != 1 {
+			fmt.Fprintf(w, "       weight %d\n", c.Weight)
+		}
+		if c.ComposeCmd != "" {
+			fmt.Fprintf(w, "       compose command %s\n", c.ComposeCmd)
+		}
+		if c.DrainURL != "" {
+			fmt.Fprintf(w, "       drain via %s, up to %s\n", c.DrainURL, cfg.DrainTimeout)
+		}
+		for _, id := range slices.Sorted(maps.Keys(c.Folders)) {
+			fmt.Fprintf(w, "       prover %d in %s\n", id, c.Folders[id])
+		}
+		for _, id := range slices.Sorted(maps.Keys(c.ComposeFiles)) {
+			fmt.Fprintf(w, "       prover %d compose file %s\n", id, c.ComposeFiles[id])
+		}
+	}
+
+	fmt.Fprintf(w, "provers (%d):\n", len(cfg.Provers))
+	for i, p := range cfg.Provers {
+		fmt.Fprintf(w, "  %d. %s in %s\n", i+1, p.Address, p.Folder)
+		if p.ComposeFile != "" {
+			fmt.Fprintf(w, "       compose file %s\n", p.ComposeFile)
+		}
+		if p.Project != "" {
+			fmt.Fprintf(w, "       project %s\n", p.Project)
+		}
+		if p.APIEndpoint != "" {
+			fmt.Fprintf(w, "       api endpoint %s\n", p.APIEndpoint)
+		}
+	}
+}
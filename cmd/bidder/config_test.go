@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseClusterAddr(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  Cluster
+	}{
+		{"10.0.0.1", Cluster{IP: "10.0.0.1"}},
+		{"10.0.0.1:2222", Cluster{IP: "10.0.0.1", Port: 2222}},
+		{"2001:db8::1", Cluster{IP: "2001:db8::1"}},
+		{"[2001:db8::1]", Cluster{IP: "2001:db8::1"}},
+		{"[2001:db8::1]:2222", Cluster{IP: "2001:db8::1", Port: 2222}},
+		{"gpu-1.internal:22", Cluster{IP: "gpu-1.internal", Port: 22}},
+	}
+	for _, tt := range tests {
+		got, err := parseClusterAddr(tt.entry)
+		if err != nil || got.IP != tt.want.IP || got.Port != tt.want.Port {
+			t.Errorf("parseClusterAddr(%q) = %+v, %v; want %+v", tt.entry, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseClusterAddrBadPort(t *testing.T) {
+	for _, entry := range []string{
+		"10.0.0.1:0", "10.0.0.1:65536", "10.0.0.1:-1", "10.0.0.1:ssh", "10.0.0.1:",
+		"[2001:db8::1]:0", "[2001:db8::1]:99999", "[2001:db8::1]:x",
+	} {
+		if c, err := parseClusterAddr(entry); err == nil {
+			t.Errorf("parseClusterAddr(%q) = %+v, want an invalid port error", entry, c)
+		}
+	}
+}
+
+func TestClusterKey(t *testing.T) {
+	tests := []struct {
+		c    Cluster
+		want string
+	}{
+		{Cluster{IP: "10.0.0.1", Port: 22}, "10.0.0.1:22"},
+		{Cluster{IP: "2001:db8::1", Port: 2222}, "[2001:db8::1]:2222"},
+	}
+	for _, tt := range tests {
+		if got := clusterKey(tt.c); got != tt.want {
+			t.Errorf("clusterKey(%+v) = %q, want %q", tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestClusterIPsEnv(t *testing.T) {
+	t.Setenv("CLUSTER_IPS", "10.0.0.1, 2001:db8::1,[2001:db8::2]:2222,")
+	var cfg Config
+	if err := applyEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, c := range cfg.Clusters {
+		if c.Port == 0 {
+			c.Port = 22
+		}
+		keys = append(keys, clusterKey(c))
+	}
+	if got, want := strings.Join(keys, " "), "10.0.0.1:22 [2001:db8::1]:22 [2001:db8::2]:2222"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	t.Setenv("CLUSTER_IPS", "10.0.0.1:22,[2001:db8::1]:70000,10.0.0.3:ssh")
+	err := applyEnv(&Config{})
+	if err == nil || !strings.Contains(err.Error(), `invalid port "70000"`) || !strings.Contains(err.Error(), `invalid port "ssh"`) {
+		t.Errorf("got %v, want both bad ports reported", err)
+	}
+}
+
+func TestParsePasswords(t *testing.T) {
+	tests := []struct {
+		s, delim string
+		want     []string
+	}{
+		{"pass1,pass2", "", []string{"pass1", "pass2"}},
+		{" pass1 , pass2 ", "", []string{"pass1", "pass2"}},
+		{`["a,b", " c d ", "e\"f"]`, "", []string{"a,b", " c d ", `e"f`}},
+		{` ["x"]`, "", []string{"x"}},
+		{"a,b|c d", "|", []string{"a,b", "c d"}},
+		{"a,b:: c d ::e", "::", []string{"a,b", "c d", "e"}},
+		{"pass1,,pass3", "", []string{"pass1", "", "pass3"}},
+	}
+	for _, tt := range tests {
+		got, err := parsePasswords(tt.s, tt.delim)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("parsePasswords(%q, %q) = %q, %v; want %q", tt.s, tt.delim, got, err, tt.want)
+		}
+	}
+}
+
+func TestParsePasswordsBadJSON(t *testing.T) {
+	_, err := parsePasswords(`["s3cret,`, "")
+	if err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("got %v, want an error that doesn't quote the password", err)
+	}
+}
+
+func TestSSHPasswordsEnv(t *testing.T) {
+	t.Setenv("CLUSTER_IPS", "10.0.0.1,10.0.0.2")
+	t.Setenv("SSH_PASSWORDS", `["a,b", "c d"]`)
+	var cfg Config
+	if err := applyEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Clusters[0].Password != "a,b" || cfg.Clusters[1].Password != "c d" {
+		t.Errorf("got %+v", cfg.Clusters)
+	}
+
+	t.Setenv("SSH_PASSWORDS", "a,b|c, d")
+	t.Setenv("SSH_PASSWORD_DELIM", "|")
+	cfg = Config{}
+	if err := applyEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Clusters[0].Password != "a,b" || cfg.Clusters[1].Password != "c, d" {
+		t.Errorf("got %+v", cfg.Clusters)
+	}
+
+	// Read with the default comma, the same passwords are three entries.
+	t.Setenv("SSH_PASSWORD_DELIM", "")
+	err := applyEnv(&Config{})
+	if err == nil || !strings.Contains(err.Error(), "SSH_PASSWORDS has 3 entries but there are 2 clusters") {
+		t.Errorf("got %v, want a count mismatch", err)
+	}
+}
+
+func TestStallTimeoutAllowsForSwitchDeadline(t *testing.T) {
+	// The poll interval with jitter is 30s, and a poll of 3 attempts of 5s
+	// each with up to 1.5s of backoff takes up to 16.5s per endpoint.
+	tests := []struct {
+		lines   []string
+		wantErr string
+	}{
+		{[]string{"stall_timeout: 10m"}, "STALL_TIMEOUT requires SWITCH_DEADLINE"},
+		{[]string{"stall_timeout: 2m", "switch_deadline: 2m"}, "SERVING_PROBE_TIMEOUT together (2m46.5s)"},
+		{[]string{"stall_timeout: 2m46.5s", "switch_deadline: 2m"}, "(2m46.5s), got 2m46.5s"},
+		{[]string{"stall_timeout: 2m47s", "switch_deadline: 2m"}, ""},
+		{[]string{"switch_deadline: 2m"}, ""},
+		{[]string{"stall_timeout: 2m36s", "switch_deadline: 2m", "api_retries: 1"}, ""},
+		{[]string{"stall_timeout: 2m47s", "switch_deadline: 2m", "api_batch_endpoint: http://127.0.0.1:1/batch"}, "(3m3s)"},
+		{[]string{"stall_timeout: 3m", "switch_deadline: 2m", "serving_probe_url: http://127.0.0.1:1/ready", "serving_probe_timeout: 1m"}, "(3m46.5s)"},
+		{[]string{"stall_timeout: 3m47s", "switch_deadline: 2m", "serving_probe_url: http://127.0.0.1:1/ready", "serving_probe_timeout: 1m"}, ""},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		config := testConfig(t.TempDir()) + "poll_interval: 20s\npoll_jitter: 0.5\napi_timeout: 5s\n" + strings.Join(tt.lines, "\n") + "\n"
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(path)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%v: %v", tt.lines, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%v: got %v, want %q", tt.lines, err, tt.wantErr)
+		}
+	}
+}
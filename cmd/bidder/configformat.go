@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormats decodes config files in formats other than YAML, by file
+// extension, into plain values for decodeConfig. Anything else is read as
+// YAML.
+var configFormats = map[string]func(data []byte) (any, error){
+	".json": decodeJSONConfig,
+	".toml": decodeTOMLConfig,
+}
+
+// decodeConfig parses data, in the format path's extension names, into cfg.
+// Every format uses the yaml field names and value syntax, so a key means the
+// same whichever format it is written in.
+func decodeConfig(path string, data []byte, cfg *Config) error {
+	decode, ok := configFormats[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return yaml.Unmarshal(data, cfg)
+	}
+	v, err := decode(data)
+	if err != nil {
+		return err
+	}
+	return yamlNode(v).Decode(cfg)
+}
+
+func decodeJSONConfig(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the top-level value")
+	}
+	return v, nil
+}
+
+func decodeTOMLConfig(data []byte) (any, error) {
+	var v map[string]any
+	if _, err := toml.Decode(string(data), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// yamlNode builds the YAML node for a decoded JSON or TOML value. Map keys
+// are left untagged so they resolve as in a YAML file, where the prover IDs
+// of cluster folders are numbers; string values stay strings.
+func yamlNode(v any) *yaml.Node {
+	scalar := func(tag, value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k}, yamlNode(v[k]))
+		}
+		return n
+	case []map[string]any:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, e := range v {
+			n.Content = append(n.Content, yamlNode(e))
+		}
+		return n
+	case []any:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, e := range v {
+			n.Content = append(n.Content, yamlNode(e))
+		}
+		return n
+	case string:
+		return scalar("!!str", v)
+	case bool:
+		return scalar("!!bool", strconv.FormatBool(v))
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return scalar("!!int", v.String())
+		}
+		return scalar("!!float", v.String())
+	case int64:
+		return scalar("!!int", strconv.FormatInt(v, 10))
+	case float64:
+		return scalar("!!float", strconv.FormatFloat(v, 'g', -1, 64))
+	case time.Time:
+		return scalar("!!timestamp", v.Format(time.RFC3339Nano))
+	case nil:
+		return scalar("!!null", "null")
+	default:
+		return scalar("!!str", fmt.Sprint(v))
+	}
+}
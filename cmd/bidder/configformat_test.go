@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The same config in every format loadConfigFile reads.
+var configInFormats = map[string]string{
+	".yaml": `api_endpoint: http://orders.example/is-assigned
+poll_interval: 2s
+split_ratio: [1.5, 1]
+dry_run: true
+clusters:
+  - ip: 10.0.0.1
+    password: pass1
+    folders:
+      1: /opt/p1
+      2: ~/p2 on gpu
+  - ip: 2001:db8::1
+    port: 2222
+    key_path: ~/.ssh/id_ed25519
+provers:
+  - address: "0x1111111111111111111111111111111111111111"
+  - address: "0x2222222222222222222222222222222222222222"
+    folder: "0002"
+`,
+	".json": `{
+  "api_endpoint": "http://orders.example/is-assigned",
+  "poll_interval": "2s",
+  "split_ratio": [1.5, 1],
+  "dry_run": true,
+  "clusters": [
+    {"ip": "10.0.0.1", "password": "pass1", "folders": {"1": "/opt/p1", "2": "~/p2 on gpu"}},
+    {"ip": "2001:db8::1", "port": 2222, "key_path": "~/.ssh/id_ed25519"}
+  ],
+  "provers": [
+    {"address": "0x1111111111111111111111111111111111111111"},
+    {"address": "0x2222222222222222222222222222222222222222", "folder": "0002"}
+  ]
+}
+`,
+	".toml": `api_endpoint = "http://orders.example/is-assigned"
+poll_interval = "2s"
+split_ratio = [1.5, 1]
+dry_run = true
+
+[[clusters]]
+ip = "10.0.0.1"
+password = "pass1"
+folders = { 1 = "/opt/p1", 2 = "~/p2 on gpu" }
+
+[[clusters]]
+ip = "2001:db8::1"
+port = 2222
+key_path = "~/.ssh/id_ed25519"
+
+[[provers]]
+address = "0x1111111111111111111111111111111111111111"
+
+[[provers]]
+address = "0x2222222222222222222222222222222222222222"
+folder = "0002"
+`,
+}
+
+func TestConfigFormatsDecodeAlike(t *testing.T) {
+	dir := t.TempDir()
+	load := func(ext, format string) *Config {
+		t.Helper()
+		path := filepath.Join(dir, "config"+ext)
+		if err := os.WriteFile(path, []byte(configInFormats[format]), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfigFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		return cfg
+	}
+
+	want := load(".yaml", ".yaml")
+	if want.PollInterval != 2*time.Second || !reflect.DeepEqual(want.SplitRatio, []float64{1.5, 1}) ||
+		!reflect.DeepEqual(want.Clusters[0].Folders, map[int]string{1: "/opt/p1", 2: "~/p2 on gpu"}) ||
+		want.Clusters[1].Port != 2222 || want.Provers[1].Folder != "0002" || !want.DryRun {
+		t.Fatalf("YAML decoded as %+v", want)
+	}
+	for ext, format := range map[string]string{".yml": ".yaml", ".json": ".json", ".toml": ".toml"} {
+		if got := load(ext, format); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decoded as\n%+v\nwant\n%+v", ext, got, want)
+		}
+	}
+}
+
+func TestConfigFormatErrors(t *testing.T) {
+	for ext, data := range map[string]string{
+		".json": `{"poll_interval": "2s"} {}`,
+		".toml": `poll_interval = `,
+		".yaml": "poll_interval: [2s",
+	} {
+		path := filepath.Join(t.TempDir(), "config"+ext)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfigFile(path); err == nil {
+			t.Errorf("%s: %q parsed", ext, data)
+		}
+	}
+}
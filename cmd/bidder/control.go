@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows burst requests at once, refilled at rate per second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perMinute, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take spends a token if one is available, and otherwise returns how long
+// until the next one is.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// controlLimiter is shared by every mutating endpoint.
+var controlLimiter *tokenBucket
+
+// control guards a mutating endpoint with the control token, when one is
+// set, and the control rate limit.
+func control(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if controlToken != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(controlToken)) != 1 {
+				slog.Warn("Rejected unauthorized control request",
+					"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if ok, wait := controlLimiter.take(); !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", fmt.Sprint(secs))
+			http.Error(w, fmt.Sprintf("rate limit exceeded, retry in %ds", secs), http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// applyWithDeadline is applyAssignment bounded by switchDeadline, so a switch
+// across a large fleet can't run into the next poll. Clusters still switching
+// when it passes are abandoned, their commands cancelled, and recorded in
+// unfinished for resumeSwitch to retry. Like applyAssignment, callers must
+// hold a switch from beginSwitch but not mu.
+func applyWithDeadline(ctx context.Context, b switchBatch) (int, error) {
+	applyCtx := ctx
+	if switchDeadline > 0 {
+		var cancel context.CancelFunc
+		applyCtx, cancel = context.WithTimeout(ctx, switchDeadline)
+		defer cancel()
+	}
+	errs := switchClusters(applyCtx, b.clusters, b.known, b.todo)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	ok, err := b.record(errs)
+	for i, c := range b.clusters {
+		if b.assignment[i] != 0 {
+			delete(unfinished, clusterKey(c))
+		}
+	}
+	if ctx.Err() != nil || !errors.Is(applyCtx.Err(), context.DeadlineExceeded) {
+		return ok, err
+	}
+	var late []string
+	for i, c := range clusters {
+		j := b.index(clusterKey(c))
+		if j >= 0 && b.todo[j] != 0 && clusterProvers[i] != b.todo[j] {
+			unfinished[clusterKey(c)] = b.todo[j]
+			late = append(late, clusterKey(c))
+		}
+	}
+	if len(late) > 0 {
+		slog.Warn("Switch deadline passed, abandoning unfinished clusters until the next poll",
+			"deadline", switchDeadline.String(), "clusters", late)
+	}
+	return ok, err
+}
+
+// resumeSwitch retries the clusters the last switch abandoned at its
+// deadline, once the poll loop still wants the state that switch set up.
+func resumeSwitch(ctx context.Context) error {
+	mu.Lock()
+	pending := len(unfinished)
+	mu.Unlock()
+	if pending == 0 {
+		return nil
+	}
+
+	ctx, done, started := beginSwitch(ctx, "resume")
+	if !started {
+		return nil
+	}
+	defer done()
+
+	mu.Lock()
+	assignment := make([]int, len(clusters))
+	var keys []string
+	for i, c := range clusters {
+		if target, ok := unfinished[clusterKey(c)]; ok && !quarantined[clusterKey(c)] {
+			assignment[i] = target
+			keys = append(keys, clusterKey(c))
+		}
+	}
+	// Clusters removed by a reload are gone for good.
+	clear(unfinished)
+	b := newSwitchBatch(assignment)
+	mu.Unlock()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slog.Info("Retrying clusters unfinished at the last switch deadline", "clusters", keys)
+	start := time.Now()
+	ok, err := applyWithDeadline(ctx, b)
+
+	mu.Lock()
+	defer mu.Unlock()
+	saveState()
+	slog.Info("Resumed switch", "clusters", ok, "total", len(keys),
+		"still_unfinished", len(unfinished), "duration_ms", time.Since(start).Milliseconds())
+	return err
+}
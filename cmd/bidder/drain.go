@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	drainPollInterval   = 5 * time.Second
+	drainRequestTimeout = 10 * time.Second
+)
+
+var drainClient = &http.Client{Timeout: drainRequestTimeout}
+
+// drainStatus is the response to GET on a cluster's drain URL.
+type drainStatus struct {
+	Idle bool `json:"idle"`
+}
+
+// drainAndStop stops provers ids on the cluster, which last ran prover
+// running. If the cluster has a drain URL and running is among ids, the
+// prover is first asked to drain and given up to drainTimeout to finish the
+// job in hand, so the stop doesn't kill a proof. Stopping idle provers sends
+// nothing. A drain that fails or times out is logged and the provers are
+// stopped anyway.
+func drainAndStop(ctx context.Context, cluster Cluster, running int, ids []int) []error {
+	if cluster.DrainURL != "" && running != 0 && slices.Contains(ids, running) {
+		start := time.Now()
+		if err := drain(ctx, cluster); err != nil {
+			slog.Warn("Drain failed, stopping now", "cluster_ip", cluster.IP,
+				"duration_ms", time.Since(start).Milliseconds(), "error", err)
+		} else {
+			slog.Info("Cluster drained", "cluster_ip", cluster.IP, "duration_ms", time.Since(start).Milliseconds())
+		}
+	}
+
+	var errs []error
+	for _, id := range ids {
+		errs = append(errs, sshDockerCompose(ctx, cluster, id, "stop"))
+	}
+	return errs
+}
+
+// drain POSTs to the cluster's drain URL and polls it with GET until it
+// reports idle or drainTimeout passes.
+func drain(ctx context.Context, cluster Cluster) error {
+	if dryRun {
+		slog.Info("Dry run: would drain", "cluster_ip", cluster.IP, "drain_url", cluster.DrainURL)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+
+	if _, err := drainRequest(ctx, http.MethodPost, cluster.DrainURL); err != nil {
+		return err
+	}
+	for {
+		status, err := drainRequest(ctx, http.MethodGet, cluster.DrainURL)
+		switch {
+		case err == nil && status.Idle:
+			return nil
+		case ctx.Err() != nil:
+			return fmt.Errorf("not idle after %s", drainTimeout)
+		case err != nil:
+			// The prover may be busy enough to miss a poll; keep trying.
+			slog.Debug("Drain status check failed", "cluster_ip", cluster.IP, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+// drainRequest sends method to url and decodes any JSON response.
+func drainRequest(ctx context.Context, method, url string) (drainStatus, error) {
+	var status drainStatus
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := drainClient.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return status, fmt.Errorf("drain %s returned %d", method, resp.StatusCode)
+	}
+	if method == http.MethodGet {
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return status, fmt.Errorf("decode drain status: %w", err)
+		}
+	}
+	return status, nil
+}
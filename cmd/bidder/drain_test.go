@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDrainOnlyRunningProver(t *testing.T) {
+	var mu sync.Mutex
+	drains := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			mu.Lock()
+			drains++
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"idle":true}`))
+	}))
+	t.Cleanup(api.Close)
+	config := testConfig(t.TempDir())
+	for _, pass := range []string{"pass1", "pass2"} {
+		config = strings.Replace(config, "password: "+pass+"\n", "password: "+pass+"\n    drain_url: "+api.URL+"\n", 1)
+	}
+	loadTestConfig(t, config+"switch_order: stop_first\n")
+	startSSHServer(t)
+
+	// Nothing is known to run yet, so stopping prover 2 stops an idle prover.
+	if err := switchProver(context.Background(), 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if drains != 0 {
+		t.Errorf("%d drain requests stopping idle provers, want none", drains)
+	}
+
+	lastSwitch = lastSwitch.AddDate(-1, 0, 0)
+	if err := switchProver(context.Background(), 2, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if drains != 2 {
+		t.Errorf("%d drain requests stopping prover 1, want one per cluster", drains)
+	}
+}
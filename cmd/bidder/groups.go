@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// groupTarget is what the clusters of one group should run.
+type groupTarget struct {
+	group   string
+	provers []int // in ID order
+	weights []int // split weights, parallel to provers
+	reason  string
+}
+
+func (t groupTarget) String() string {
+	return fmt.Sprintf("%s=%v", t.group, t.provers)
+}
+
+// pendingSwitch is a group's debounce progress, as pendingTarget and
+// pendingCount are the fleet's.
+type pendingSwitch struct {
+	target []int
+	count  int
+}
+
+// groupMembers returns the names of the cluster groups, in order of first
+// appearance, and the cluster indices of each. Callers must hold mu.
+func groupMembers() ([]string, map[string][]int) {
+	var names []string
+	members := map[string][]int{}
+	for _, m := range clusterGroups() {
+		g := clusters[m[0]].Group
+		names = append(names, g)
+		members[g] = m
+	}
+	return names, members
+}
+
+// groupProvers returns the provers running on the clusters members, in ID
+// order. Quarantined clusters and ones whose state is unknown are left out.
+// Callers must hold mu.
+func groupProvers(members []int) []int {
+	var running []int
+	for _, i := range members {
+		if p := clusterProvers[i]; p != 0 && !quarantined[clusterKey(clusters[i])] && !slices.Contains(running, p) {
+			running = append(running, p)
+		}
+	}
+	slices.Sort(running)
+	return running
+}
+
+// pollGroupOrders fetches the order status of every prover in each group from
+// groupOrderSource, checking the groups at once.
+func pollGroupOrders(ctx context.Context, groups []string) (map[string]map[int]AssignedOrder, map[string]error) {
+	results := make([]map[string]AssignedOrder, len(groups))
+	resultErrs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		wg.Add(1)
+		go func(idx int, group string) {
+			defer wg.Done()
+			results[idx], resultErrs[idx] = groupOrderSource.GroupOrders(ctx, group)
+		}(i, g)
+	}
+	wg.Wait()
+
+	orders := make(map[string]map[int]AssignedOrder, len(groups))
+	errs := make(map[string]error)
+	for i, g := range groups {
+		if resultErrs[i] != nil {
+			errs[g] = resultErrs[i]
+			continue
+		}
+		byID := make(map[int]AssignedOrder)
+		for _, id := range proverIDs() {
+			byID[id] = results[i][proverAddresses[id]]
+		}
+		orders[g] = byID
+	}
+	return orders, errs
+}
+
+// groupDebounced is debounced for one group whose clusters run current.
+func groupDebounced(group string, target, current []int) bool {
+	if len(current) == 0 {
+		return true
+	}
+	p := groupPending[group]
+	if !slices.Equal(p.target, target) {
+		p = pendingSwitch{target: slices.Clone(target)}
+	}
+	p.count++
+	if p.count < switchDebounce {
+		groupPending[group] = p
+		slog.Info("Group switch pending", "group", group, "provers", target,
+			"polls", p.count, "required", switchDebounce)
+		return false
+	}
+	delete(groupPending, group)
+	return true
+}
+
+// runGroups is runOnce for ORDER_SOURCE=group: each cluster group is polled
+// for its own orders and decided on its own, so different groups can run
+// different provers at once. A group whose check fails falls back on its own.
+func runGroups(ctx context.Context) error {
+	mu.Lock()
+	names, members := groupMembers()
+	mu.Unlock()
+
+	ids := proverIDs()
+	orders, groupErrs := pollGroupOrders(ctx, names)
+
+	var errs []string
+	var results []orderResult
+	timedOut := false
+	polled := time.Now()
+	for _, g := range names {
+		err := groupErrs[g]
+		for _, id := range ids {
+			results = append(results, newOrderResult(id, g, orders[g][id], err, polled))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("group %s: %v", g, err))
+			timedOut = timedOut || errors.Is(err, errAPITimeout)
+		}
+	}
+	recordOrders(results)
+	for _, id := range ids {
+		var err error
+		assigned := false
+		for _, g := range names {
+			if groupErrs[g] != nil {
+				err = groupErrs[g]
+				continue
+			}
+			assigned = assigned || orders[g][id].OrderExists
+		}
+		recordPoll(id, assigned, err)
+		if err != nil {
+			orderCheckErrorsTotal.WithLabelValues(strconv.Itoa(id)).Inc()
+		}
+	}
+
+	var pollErr error
+	if len(errs) > 0 {
+		pollErr = fmt.Errorf("order checks failed: %s", strings.Join(errs, "; "))
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	recordPollOutcome(pollErr != nil)
+
+	if prover, remaining := activeOverride(); prover != 0 {
+		slog.Debug("Override active, ignoring orders",
+			"prover", prover, "remaining", remaining.Round(time.Second).String())
+		markPollCompleted()
+		return pollErr
+	}
+
+	var targets []groupTarget
+	for _, g := range names {
+		var checkErrs map[int]error
+		if err := groupErrs[g]; err != nil {
+			checkErrs = make(map[int]error, len(ids))
+			for _, id := range ids {
+				checkErrs[id] = err
+			}
+		}
+		d := decideAction(ids, orders[g], checkErrs, splitMinOrders, len(members[g]), false, disableSplit)
+		if len(d.Contenders) > 0 {
+			mu.Lock()
+			current := groupProvers(members[g])
+			mu.Unlock()
+			logTieBreak(ctx, g, d, orders[g], current)
+		}
+		switch d.Action {
+		case KeepCurrent:
+			delete(groupPending, g)
+		case FallbackDefault:
+			targets = append(targets, groupTarget{group: g, provers: []int{fallbackProver}, weights: []int{1}, reason: "fallback"})
+		default:
+			targets = append(targets, groupTarget{group: g, provers: d.Provers, weights: d.Weights, reason: "orders"})
+		}
+	}
+	slog.Debug("Poll decision", "groups", len(names), "failed_checks", len(errs), "targets", fmt.Sprint(targets))
+
+	if inMaintenance(time.Now()) {
+		slog.Info("Maintenance window, holding current state", "would", fmt.Sprint(targets), "errors", errs)
+		markPollCompleted()
+		return pollErr
+	}
+	if len(targets) > 0 {
+		idleSince = time.Time{}
+	}
+	if len(errs) > 0 {
+		slog.Warn("Order checks failed, falling back in those groups",
+			"fallback_prover", fallbackProver, "timed_out", timedOut, "errors", errs)
+	}
+
+	// Only groups whose clusters aren't already running their target switch.
+	mu.Lock()
+	var changed []groupTarget
+	for _, t := range targets {
+		current := groupProvers(members[t.group])
+		switch {
+		case slices.Equal(current, t.provers):
+			delete(groupPending, t.group)
+		case t.reason == "fallback" || groupDebounced(t.group, t.provers, current):
+			changed = append(changed, t)
+		}
+	}
+	mu.Unlock()
+
+	var switchErr error
+	switch {
+	case len(changed) > 0:
+		switchErr = switchGroups(ctx, changed)
+	case len(targets) == 0 && pollErr == nil:
+		if idle, due := idleShutdownDue(); due {
+			slog.Info("No orders for the idle shutdown period, stopping all provers",
+				"idle", idle.Round(time.Second).String())
+			switchErr = stopAll(ctx, "idle")
+			break
+		}
+		slog.Info("No orders in any group, keeping current provers")
+		switchErr = resumeSwitch(ctx)
+	default:
+		switchErr = resumeSwitch(ctx)
+	}
+	markPollCompleted()
+	return errors.Join(pollErr, switchErr)
+}
+
+// switchGroups moves the clusters of each target group to its provers,
+// leaving every other group alone. The fleet's state then follows what runs
+// across all groups: one prover if they agree, or else a split across the
+// provers between them. Errors are reported as by switchProver. As in
+// switchTo, the clusters switch without mu held.
+func switchGroups(ctx context.Context, targets []groupTarget) error {
+	keys := make([]string, len(targets))
+	for i, t := range targets {
+		keys[i] = t.String()
+	}
+	ctx, done, started := beginSwitch(ctx, "groups "+strings.Join(keys, " "))
+	if !started {
+		slog.Debug("Same group switch already in progress", "groups", keys)
+		return nil
+	}
+	defer done()
+
+	mu.Lock()
+	if remaining := cooldownRemaining(); remaining > 0 {
+		mu.Unlock()
+		slog.Info("Switch cooldown active, not switching groups",
+			"groups", keys, "remaining", remaining.Round(time.Second).String())
+		return nil
+	}
+
+	_, members := groupMembers()
+	assignment := make([]int, len(clusters))
+	reason := "fallback"
+	for _, t := range targets {
+		weights := t.weights
+		if len(splitRatio) > 0 {
+			weights = make([]int, len(t.provers))
+			for k, id := range t.provers {
+				weights[k] = splitRatio[id-1]
+			}
+		}
+		// A group removed by a reload since the poll has no members.
+		assignGroup(assignment, members[t.group], t.provers, weights)
+		if t.reason != "fallback" {
+			reason = "orders"
+		}
+	}
+	b := newSwitchBatch(assignment)
+	mu.Unlock()
+	slog.Info("Switching groups", "groups", keys, "reason", reason)
+	start := time.Now()
+
+	ok, err := applyWithDeadline(ctx, b)
+	elapsed := time.Since(start)
+	switchDuration.WithLabelValues("groups").Observe(elapsed.Seconds())
+	if ok == 0 {
+		mu.Lock()
+		for i, c := range b.clusters {
+			if b.assignment[i] != 0 {
+				delete(unfinished, clusterKey(c))
+			}
+		}
+		dropOutOfSync(b)
+		mu.Unlock()
+		slog.Error("Group switch failed on every cluster, keeping previous state", "groups", keys,
+			"duration_ms", elapsed.Milliseconds())
+		if err == nil {
+			err = fmt.Errorf("no cluster switched for groups %s", strings.Join(keys, ", "))
+		}
+		return err
+	}
+
+	var probe []int
+	for _, t := range targets {
+		for _, id := range t.provers {
+			if !slices.Contains(probe, id) {
+				probe = append(probe, id)
+			}
+		}
+	}
+	notServing, probeErr := probeServing(ctx, probe)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	all := make([]int, len(clusters))
+	for i := range all {
+		all[i] = i
+	}
+	running := groupProvers(all)
+
+	from := currentState()
+	lastSwitch = time.Now()
+	ev := switchEvent{OldProver: currentActiveProver, Timestamp: lastSwitch, Reason: reason, NotServing: notServing}
+	if len(running) == 1 {
+		currentActiveProver, splitMode, splitActive = running[0], false, nil
+		ev.NewProver = running[0]
+		switchesTotal.WithLabelValues(strconv.Itoa(running[0])).Inc()
+	} else {
+		currentActiveProver, splitMode, splitActive = 0, true, running
+		ev.SplitMode, ev.SplitProvers = true, running
+		splitActivationsTotal.Inc()
+	}
+	recordSwitch(ev)
+	markActive(lastSwitch)
+	saveState()
+	activeProverGauge.Set(float64(currentActiveProver))
+	slog.Info("Groups switched", "groups", keys,
+		"clusters", ok, "total", len(clusters), "duration_ms", elapsed.Milliseconds())
+	logTransition(from, currentState(), reason, ok)
+	return errors.Join(err, probeErr)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testConfig is a minimal valid config: two password clusters and two
+// provers, with the state file under dir.
+func testConfig(dir string) string {
+	return `api_endpoint: http://127.0.0.1:1/is-assigned
+state_file: ` + filepath.Join(dir, "state.json") + `
+clusters:
+  - ip: 10.0.0.1
+    password: pass1
+  - ip: 10.0.0.2
+    password: pass2
+provers:
+  - address: "0x1111111111111111111111111111111111111111"
+  - address: "0x2222222222222222222222222222222222222222"
+`
+}
+
+// loadTestConfig resets the global state and loads config, written to a YAML
+// file, the way main does at startup. It returns the file's path.
+func loadTestConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	resetState()
+	if err := loadEnv(path); err != nil {
+		t.Fatalf("loadEnv: %v", err)
+	}
+	t.Cleanup(closePool)
+	return path
+}
+
+// withConfigLines loads testConfig with extra top-level lines appended,
+// returning the config file's path.
+func withConfigLines(t *testing.T, lines ...string) string {
+	t.Helper()
+	return loadTestConfig(t, testConfig(t.TempDir())+strings.Join(lines, "\n")+"\n")
+}
+
+// resetState clears everything loadEnv and earlier switches leave behind.
+func resetState() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	proverFolders = map[int]string{}
+	proverComposeFiles = map[int]string{}
+	proverProjects = map[int]string{}
+	proverAddresses = map[int]string{}
+	clear(proverAPIEndpoints)
+	currentActiveProver, splitMode, splitActive = 0, false, nil
+	activeSince = map[int]time.Time{}
+	unfinished = map[string]int{}
+	outOfSync = map[string]int{}
+	lastSwitch = time.Time{}
+	clusterProvers = nil
+	lastPoll = map[int]pollResult{}
+	lastOrders = nil
+	quarantined = map[string]bool{}
+	overrideProver, overrideUntil = 0, time.Time{}
+	breakerFailures, breakerOpenUntil = 0, time.Time{}
+	batchUnsupported = false
+	history = nil
+	pendingTarget, pendingCount = nil, 0
+	groupPending = map[string]pendingSwitch{}
+	idleSince = time.Time{}
+	lastPollCompleted.Store(0)
+	lastOrderSeen.Store(0)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// history holds the last historySize switch events, oldest first. Guarded by
+// mu.
+var history []switchEvent
+
+// recordSwitch stamps ev with the order picture that led to it, appends it to
+// the history and posts it to the webhook. Callers must hold mu.
+func recordSwitch(ev switchEvent) {
+	ev.Orders = make(map[int]bool, len(lastPoll))
+	for id, p := range lastPoll {
+		ev.Orders[id] = p.Assigned
+	}
+
+	if len(history) >= historySize {
+		history = append(history[:0], history[len(history)-historySize+1:]...)
+	}
+	history = append(history, ev)
+
+	notifySwitch(ev)
+	runSwitchHook(ev)
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	data, err := json.Marshal(history)
+	mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		slog.Warn("Failed to write history response", "error", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hookProvers is what {prover} expands to for ev: the new prover, the split
+// provers joined by commas, or 0 once every prover is stopped.
+func hookProvers(ev switchEvent) string {
+	if !ev.SplitMode {
+		return strconv.Itoa(ev.NewProver)
+	}
+	ids := make([]string, len(ev.SplitProvers))
+	for i, id := range ev.SplitProvers {
+		ids[i] = strconv.Itoa(id)
+	}
+	return strings.Join(ids, ",")
+}
+
+// runSwitchHook runs postSwitchHook through sh in the background after a
+// switch, with {prover}, {old_prover} and {reason} replaced and ev on stdin as
+// the JSON the webhook receives. Its output is logged; a failure or timeout
+// never affects the switch.
+func runSwitchHook(ev switchEvent) {
+	if postSwitchHook == "" {
+		return
+	}
+	cmd := strings.NewReplacer(
+		"{prover}", hookProvers(ev),
+		"{old_prover}", strconv.Itoa(ev.OldProver),
+		"{reason}", ev.Reason,
+	).Replace(postSwitchHook)
+	if dryRun {
+		slog.Info("Dry run: would run post-switch hook", "command", cmd)
+		return
+	}
+	input, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Failed to encode switch event for hook", "error", err)
+		return
+	}
+
+	webhooksPending.Add(1)
+	go func() {
+		defer webhooksPending.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), postSwitchHookTimeout)
+		defer cancel()
+
+		start := time.Now()
+		c := exec.CommandContext(ctx, "sh", "-c", cmd)
+		c.Stdin = bytes.NewReader(input)
+		// Children of sh can outlive it and hold the output open.
+		c.WaitDelay = time.Second
+		out, err := c.CombinedOutput()
+		attrs := []any{"command", cmd, "duration_ms", time.Since(start).Milliseconds(),
+			"output", strings.TrimSpace(string(out))}
+		switch {
+		case ctx.Err() != nil:
+			hookFailuresTotal.Inc()
+			slog.Warn("Post-switch hook timed out", append(attrs, "timeout", postSwitchHookTimeout.String())...)
+		case err != nil:
+			hookFailuresTotal.Inc()
+			slog.Warn("Post-switch hook failed", append(attrs, "error", err)...)
+		default:
+			slog.Info("Post-switch hook ran", attrs...)
+		}
+	}()
+}
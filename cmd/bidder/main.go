@@ -1,222 +1,1457 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-type AssignedOrder struct {
-	OrderExists bool `json:"assigned"`
+type Cluster struct {
+	IP       string `yaml:"ip"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"ssh_user"`
+	Password string `yaml:"password"`
+	KeyPath  string `yaml:"key_path"`
+	// PasswordFile holds the password instead of Password. When the password
+	// comes from sshPasswordDir it is set to the file that was read.
+	PasswordFile string `yaml:"password_file"`
+	// Folders overrides proverFolders for provers laid out differently on
+	// this cluster.
+	Folders map[int]string `yaml:"folders"`
+	// ComposeFiles overrides proverComposeFiles on this cluster.
+	ComposeFiles map[int]string `yaml:"compose_files"`
+	// ComposeCmd overrides composeCmd on this cluster.
+	ComposeCmd string `yaml:"compose_cmd"`
+	// DrainURL is where the cluster's running prover is asked to finish its
+	// job before being stopped. See drainAndStop.
+	DrainURL string `yaml:"drain_url"`
+	// Group names the set of clusters, such as a region, that split mode
+	// divides among the provers on its own.
+	Group string `yaml:"group"`
+	// Weight is the cluster's capacity relative to the others, such as its
+	// GPU count. Split mode divides each group by weight rather than by
+	// cluster count. Defaults to 1.
+	Weight int `yaml:"weight"`
 }
 
-type Cluster struct {
-	IP       string
-	Password string
+// LogValue keeps the password out of logs.
+func (c Cluster) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("ip", c.IP),
+		slog.Int("port", c.Port),
+		slog.String("user", c.User),
+	)
+}
+
+// folder returns the compose folder of prover id on this cluster.
+func (c Cluster) folder(id int) string {
+	if f, ok := c.Folders[id]; ok {
+		return f
+	}
+	return proverFolders[id]
+}
+
+// composeFile returns the compose file of prover id on this cluster, or ""
+// for the compose command's default.
+func (c Cluster) composeFile(id int) string {
+	if f, ok := c.ComposeFiles[id]; ok {
+		return f
+	}
+	return proverComposeFiles[id]
+}
+
+// compose returns the docker compose command to run on this cluster.
+func (c Cluster) compose() string {
+	if c.ComposeCmd != "" {
+		return c.ComposeCmd
+	}
+	return composeCmd
 }
 
 var (
 	sshUser string
 
-	proverFolders = map[int]string{
-		1: "~/prover-1-aux-cluster",
-		2: "~/prover-2-aux-cluster",
-	}
+	proverFolders      = map[int]string{}
+	proverComposeFiles = map[int]string{} // "" uses the compose default
+	proverProjects     = map[int]string{} // "" lets compose name it after the folder
+	proverAddresses    = map[int]string{}
 
-	currentActiveProver = 0
-	splitMode           = false
-	mu                  sync.Mutex
-	clusters        []Cluster
-	apiEndpoint     string
-	prover1Address  string
-	prover2Address  string
+	// The switch state, with the rest of the mutable state below, is guarded
+	// by mu. Code without mu held reads it through snapshotState.
+	currentActiveProver   = 0
+	splitMode             = false
+	splitActive           []int
+	activeSince           = map[int]time.Time{} // when each running prover became active
+	unfinished            = map[string]int{}    // clusterKey → prover, for clusters abandoned at switchDeadline
+	outOfSync             = map[string]int{}    // clusterKey → prover, for clusters whose last switch failed
+	lastSwitch            time.Time
+	clusterProvers        []int
+	lastPoll              = map[int]pollResult{}
+	mu                    sync.Mutex
+	switchMu              sync.Mutex          // guards inFlight and the reconcile fields, so it can be used while mu is held
+	inFlight              *switchInFlight     // the switch in progress, if any
+	reconcileCancel       context.CancelFunc  // cancels the reconcile in progress, if any
+	reconcileDone         chan struct{}       // closed when that reconcile returns
+	quarantined           = map[string]bool{} // clusterKeys of the clusters no switch may touch
+	clusters              []Cluster
+	apiEndpoints          []string
+	proverAPIEndpoints    = map[string]string{} // address → the prover's own order endpoint
+	pollInterval          time.Duration
+	pollJitter            float64
+	sshTimeout            time.Duration
+	sshRetries            int
+	apiClient             *http.Client
+	apiRetries            int
+	apiBatchEndpoint      string
+	apiToken              string
+	apiTokenHeader        string
+	apiUserAgent          string
+	batchUnsupported      bool
+	switchDebounce        int
+	switchCooldown        time.Duration
+	statusPort            int
+	stateFile             string
+	sshSem                chan struct{}
+	dryRun                bool
+	pprofEnabled          bool
+	warmStandby           bool
+	stopOnExit            bool
+	switchDeadline        time.Duration
+	switchStagger         time.Duration
+	warmServeAction       string
+	warmIdleAction        string
+	fallbackProver        int
+	webhookURL            string
+	postSwitchHook        string
+	postSwitchHookTimeout time.Duration
+	switchOrder           string
+	fallbackPolicy        string
+	orderSourceMode       string
+	splitMinOrders        int
+	splitRatio            []int // indexed by prover ID - 1, scaled by ratioWeights
+	composeCmd            string
+	historySize           int
+	idleShutdown          time.Duration
+	healthCheckInterval   time.Duration
+	reconcileInterval     time.Duration
+	stallTimeout          time.Duration
+	drainTimeout          time.Duration
+	servingProbeURL       string
+	servingProbeTimeout   time.Duration
+	breakerThreshold      int
+	breakerCooldown       time.Duration
+	forceSplit            bool
+	disableSplit          bool
+	hostKeyPolicy         string
+	knownHostsFile        string
+	controlToken          string
+	maintenanceWindows    []maintenanceWindow
+	overrideProver        int
+	overrideUntil         time.Time
+
+	// Only touched by the poll loop.
+	pendingTarget []int
+	pendingCount  int
+	groupPending  = map[string]pendingSwitch{} // in group mode, by group
+	idleSince     time.Time                    // start of the current run of polls without orders
 )
 
-func mustLoadEnv() {
-	ips := os.Getenv("CLUSTER_IPS")
-	if ips == "" {
-		log.Fatal("CLUSTER_IPS env var is required")
+func proverIDs() []int {
+	return slices.Sorted(maps.Keys(proverFolders))
+}
+
+// clusterKey identifies a cluster by its "host:port" address.
+func clusterKey(c Cluster) string {
+	return net.JoinHostPort(c.IP, strconv.Itoa(c.Port))
+}
+
+// activateOnCluster makes target the only prover running on the cluster. With
+// stop_first the other provers are stopped before target starts; with
+// start_first target is started and verified first, and the others are only
+// stopped once it is up, so a failed start leaves the old prover running. In
+// warm standby mode the provers are served and parked instead of started and
+// stopped. current is the prover the cluster last ran, 0 if unknown.
+func activateOnCluster(ctx context.Context, cluster Cluster, current, target int) error {
+	stopOthers := func() []error {
+		var others []int
+		for _, id := range proverIDs() {
+			if id != target {
+				others = append(others, id)
+			}
+		}
+		if warmStandby {
+			return standby(ctx, cluster, others)
+		}
+		return drainAndStop(ctx, cluster, current, others)
+	}
+	start := func() error {
+		if warmStandby {
+			return serve(ctx, cluster, target)
+		}
+		return sshDockerCompose(ctx, cluster, target, "start")
+	}
+
+	var errs []error
+	if switchOrder == switchStopFirst {
+		errs = stopOthers()
+	}
+	if err := start(); err != nil {
+		return errors.Join(append(errs, err)...)
 	}
 
-	ipList := strings.Split(ips, ",")
+	if err := verifyRunning(ctx, cluster, target); err != nil {
+		verifyFailuresTotal.WithLabelValues(cluster.IP).Inc()
+		slog.Error("Prover failed to come up", "cluster_ip", cluster.IP, "target_prover", target, "error", err)
+		return errors.Join(append(errs, err)...)
+	}
 
-	passwords := os.Getenv("SSH_PASSWORDS")
-	var passList []string
-	if passwords != "" {
-		passList = strings.Split(passwords, ",")
-		if len(passList) != len(ipList) {
-			log.Fatalf("SSH_PASSWORDS has %d entries but CLUSTER_IPS has %d — must match", len(passList), len(ipList))
+	if switchOrder == switchStartFirst {
+		errs = stopOthers()
+	}
+	return errors.Join(errs...)
+}
+
+// alreadyActive reports whether target is the only prover running on the
+// cluster. Anything it can't confirm counts as no.
+func alreadyActive(ctx context.Context, cluster Cluster, target int) bool {
+	if dryRun || verifyRunning(ctx, cluster, target) != nil {
+		return false
+	}
+	for _, id := range proverIDs() {
+		if id == target {
+			continue
+		}
+		if running, err := runningServices(ctx, cluster, id); err != nil || len(running) > 0 {
+			return false
 		}
 	}
+	return true
+}
 
-	for i, ip := range ipList {
-		c := Cluster{IP: strings.TrimSpace(ip)}
-		if len(passList) > 0 {
-			c.Password = strings.TrimSpace(passList[i])
+// switchBatch is what a switch works from: a snapshot of the clusters and
+// their known provers, taken under mu so the SSH work can run without it.
+type switchBatch struct {
+	clusters   []Cluster
+	known      []int // clusterProvers at the snapshot
+	assignment []int // the prover for each cluster, 0 to leave it alone
+	todo       []int // assignment without the quarantined clusters
+}
+
+// newSwitchBatch snapshots the clusters for switching clusters[i] to
+// assignment[i]. Quarantined clusters are left out. Callers must hold mu.
+func newSwitchBatch(assignment []int) switchBatch {
+	b := switchBatch{
+		clusters:   slices.Clone(clusters),
+		known:      slices.Clone(clusterProvers),
+		assignment: slices.Clone(assignment),
+		todo:       slices.Clone(assignment),
+	}
+	var held []string
+	for i, c := range clusters {
+		if assignment[i] != 0 && quarantined[clusterKey(c)] {
+			held = append(held, clusterKey(c))
+			b.todo[i] = 0
 		}
-		clusters = append(clusters, c)
 	}
+	if len(held) > 0 {
+		slog.Warn("Skipping quarantined clusters", "clusters", held)
+	}
+	return b
+}
+
+// index returns the position in the batch of the cluster with key, or -1.
+func (b switchBatch) index(key string) int {
+	return slices.IndexFunc(b.clusters, func(c Cluster) bool { return clusterKey(c) == key })
+}
 
-	apiEndpoint = os.Getenv("API_ENDPOINT")
-	prover1Address = os.Getenv("PROVER1_ADDRESS")
-	prover2Address = os.Getenv("PROVER2_ADDRESS")
+// applyAssignment activates the batch's assignment on every cluster in
+// parallel, blocking until all are done, and returns how many clusters now run
+// their assigned prover, with an error naming any that failed. Clusters
+// assigned 0 and quarantined clusters are left untouched and not counted.
+// Clusters already running their prover are known from clusterProvers, or
+// checked over SSH when their state is unknown, and skipped. The switches run
+// without mu, which is taken only to record the results as by record, so
+// callers must not hold mu. They must hold a switch from beginSwitch, so
+// nothing else switches the same clusters meanwhile.
+func applyAssignment(ctx context.Context, b switchBatch) (int, error) {
+	errs := switchClusters(ctx, b.clusters, b.known, b.todo)
 
-	if apiEndpoint == "" || prover1Address == "" || prover2Address == "" {
-		log.Fatal("API_ENDPOINT, PROVER1_ADDRESS, and PROVER2_ADDRESS must be set")
+	mu.Lock()
+	defer mu.Unlock()
+	return b.record(errs)
+}
+
+// record records errs, the outcome of switching the batch, in clusterProvers,
+// with 0 for clusters whose switch failed, and adds failed clusters to
+// outOfSync for reconcile. Clusters a reload removed since the snapshot are
+// left out. Callers must hold mu.
+func (b switchBatch) record(errs []error) (int, error) {
+	assignment := make([]int, len(clusters))
+	skip := make([]bool, len(clusters))
+	nowErrs := make([]error, len(clusters))
+	for i, c := range clusters {
+		j := b.index(clusterKey(c))
+		if j < 0 || b.todo[j] == 0 {
+			skip[i] = true
+			continue
+		}
+		assignment[i], nowErrs[i] = b.assignment[j], errs[j]
 	}
+	return recordAssignment(assignment, skip, nowErrs)
+}
+
+// switchClusters activates assignment[i] on cs[i] for every cluster assigned
+// a prover other than known[i], its last known prover, in parallel, and
+// returns each cluster's error. With switchStagger set, cluster switches start
+// at least that far apart. It touches no state guarded by mu.
+func switchClusters(ctx context.Context, cs []Cluster, known, assignment []int) []error {
+	errs := make([]error, len(cs))
+	wait := stagger(switchStagger)
 
-	sshUser = os.Getenv("SSH_USER")
-	if sshUser == "" {
-		sshUser = "user01"
+	var wg sync.WaitGroup
+	for i, c := range cs {
+		if assignment[i] == 0 || assignment[i] == known[i] {
+			continue
+		}
+		wg.Add(1)
+
+		go func(idx int, cluster Cluster, known int) {
+			defer wg.Done()
+			select {
+			case sshSem <- struct{}{}:
+				defer func() { <-sshSem }()
+			case <-ctx.Done():
+				errs[idx] = ctx.Err()
+				return
+			}
+			if err := wait(ctx); err != nil {
+				errs[idx] = err
+				return
+			}
+			if known == 0 && alreadyActive(ctx, cluster, assignment[idx]) {
+				slog.Info("Cluster already running prover, skipping",
+					"cluster_ip", cluster.IP, "target_prover", assignment[idx])
+				return
+			}
+			start := time.Now()
+			errs[idx] = activateOnCluster(ctx, cluster, known, assignment[idx])
+			slog.Info("Cluster switch finished", "cluster_ip", cluster.IP, "target_prover", assignment[idx],
+				"ok", errs[idx] == nil, "duration_ms", time.Since(start).Milliseconds())
+		}(i, c, known[i])
 	}
+	wg.Wait()
+	return errs
 }
 
-func sshDockerCompose(cluster Cluster, folder, action string) error {
-	remoteCmd := fmt.Sprintf("cd %s && docker compose %s", folder, action)
+// recordAssignment records in clusterProvers and outOfSync the outcome errs of
+// switching clusters to assignment, leaving out those marked in skip. It
+// returns how many clusters now run their assigned prover, with an error
+// naming any that failed. Callers must hold mu.
+func recordAssignment(assignment []int, skip []bool, errs []error) (int, error) {
+	ok := 0
+	var failed []string
+	for i, err := range errs {
+		if skip[i] {
+			continue
+		}
+		if err != nil {
+			failed = append(failed, clusterKey(clusters[i]))
+			// A failed switch may have stopped the old prover too.
+			clusterProvers[i] = 0
+			outOfSync[clusterKey(clusters[i])] = assignment[i]
+			continue
+		}
+		clusterProvers[i] = assignment[i]
+		delete(outOfSync, clusterKey(clusters[i]))
+		ok++
+	}
+	if len(failed) > 0 {
+		clusterSwitchFailuresTotal.Add(float64(len(failed)))
+		slog.Error("Clusters failed to switch",
+			"failed", len(failed), "total", len(clusters), "clusters", failed)
+		return ok, fmt.Errorf("%d of %d clusters failed to switch: %s", len(failed), len(clusters), strings.Join(failed, ", "))
+	}
+	return ok, nil
+}
 
-	var sshCmd *exec.Cmd
-	if cluster.Password != "" {
-		sshCmd = exec.Command(
-			"sshpass", "-p", cluster.Password,
-			"ssh", "-o", "StrictHostKeyChecking=no",
-			fmt.Sprintf("%s@%s", sshUser, cluster.IP),
-			remoteCmd,
-		)
-	} else {
-		sshCmd = exec.Command(
-			"ssh",
-			fmt.Sprintf("%s@%s", sshUser, cluster.IP),
-			remoteCmd,
-		)
+// stagger returns a function that blocks each caller until interval after the
+// previous one was let through, or ctx is done. Callers waiting in it hold
+// their sshSem slot, so the semaphore still bounds the clusters in progress.
+func stagger(interval time.Duration) func(ctx context.Context) error {
+	var mu sync.Mutex
+	var next time.Time
+	return func(ctx context.Context) error {
+		if interval <= 0 {
+			return nil
+		}
+		mu.Lock()
+		at := next
+		if now := time.Now(); at.Before(now) {
+			at = now
+		}
+		next = at.Add(interval)
+		mu.Unlock()
+
+		select {
+		case <-time.After(time.Until(at)):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	out, err := sshCmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("[%s] docker compose %s failed: %v\n%s",
-			cluster.IP, action, err, out)
+// cooldownRemaining returns how long until another switch is allowed. Switches
+// while no prover is active, such as the first after startup or the wake-up
+// after an idle shutdown, are never delayed. Callers must hold mu.
+func cooldownRemaining() time.Duration {
+	if lastSwitch.IsZero() || (currentActiveProver == 0 && !splitMode) {
+		return 0
 	}
+	return switchCooldown - time.Since(lastSwitch)
+}
 
-	log.Printf("[%s] docker compose %s (%s)", cluster.IP, action, folder)
-	return nil
+type switchInFlight struct {
+	target   string
+	cancel   context.CancelFunc
+	finished chan struct{} // closed when the switch returns
 }
 
-func switchProver(target int) {
+// beginSwitch returns the context for a switch to target, cancelling the
+// switch in progress since its decision is now stale, and waiting for it to
+// return, since switches run without mu. If that switch is already heading
+// for target it is left alone and ok is false. A reconcile in progress is
+// cancelled and waited for too. done must be called once the switch returns.
+func beginSwitch(parent context.Context, target string) (ctx context.Context, done func(), ok bool) {
+	switchMu.Lock()
+	if inFlight != nil && inFlight.target == target {
+		switchMu.Unlock()
+		return nil, nil, false
+	}
+	var prev chan struct{}
+	if inFlight != nil {
+		inFlight.cancel()
+		prev = inFlight.finished
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	sw := &switchInFlight{target: target, cancel: cancel, finished: make(chan struct{})}
+	inFlight = sw
+	cancelReconcile, reconciled := reconcileCancel, reconcileDone
+	switchMu.Unlock()
+
+	if prev != nil {
+		<-prev
+	}
+	if reconciled != nil {
+		cancelReconcile()
+		<-reconciled
+	}
+	return ctx, func() {
+		cancel()
+		switchMu.Lock()
+		if inFlight == sw {
+			inFlight = nil
+		}
+		switchMu.Unlock()
+		close(sw.finished)
+	}, true
+}
+
+// awaitSwitch returns once the switch in progress, if any, has returned.
+func awaitSwitch() {
+	switchMu.Lock()
+	sw := inFlight
+	switchMu.Unlock()
+	if sw != nil {
+		<-sw.finished
+	}
+}
+
+// switching reports whether a switch is in progress.
+func switching() bool {
+	switchMu.Lock()
+	defer switchMu.Unlock()
+	return inFlight != nil
+}
+
+// switchProver moves every cluster to target unless the switch cooldown is
+// still running. reason is reported to the webhook. The error reports clusters
+// that failed to switch; a skipped switch is not an error.
+func switchProver(ctx context.Context, target int, reason string) error {
+	ctx, done, started := beginSwitch(ctx, fmt.Sprintf("prover %d", target))
+	if !started {
+		slog.Debug("Switch to the same prover already in progress", "target_prover", target)
+		return nil
+	}
+	defer done()
+
 	mu.Lock()
-	defer mu.Unlock()
+	current, remaining := currentActiveProver, cooldownRemaining()
+	mu.Unlock()
+	if target == current {
+		return nil
+	}
+	if remaining > 0 {
+		slog.Info("Switch cooldown active, not switching",
+			"target_prover", target, "remaining", remaining.Round(time.Second).String())
+		return nil
+	}
+	return switchTo(ctx, target, reason)
+}
 
+// switchTo moves every cluster to target. The switch takes effect if at least
+// one cluster made it, even when it returns an error for the others or target
+// then fails its serving probe. mu is held only to snapshot the clusters and
+// to record the outcome, not while they switch, so callers must hold a switch
+// from beginSwitch but not mu.
+func switchTo(ctx context.Context, target int, reason string) error {
+	mu.Lock()
 	if target == currentActiveProver {
-		return
+		mu.Unlock()
+		return nil
+	}
+	slog.Info("Switching prover", "target_prover", target, "reason", reason, "clusters", len(clusters))
+	assignment := make([]int, len(clusters))
+	for i := range assignment {
+		assignment[i] = target
+	}
+	b := newSwitchBatch(assignment)
+	mu.Unlock()
+
+	start := time.Now()
+	ok, err := applyWithDeadline(ctx, b)
+	elapsed := time.Since(start)
+	switchDuration.WithLabelValues("switch").Observe(elapsed.Seconds())
+	if ok == 0 {
+		mu.Lock()
+		clear(unfinished)
+		dropOutOfSync(b)
+		mu.Unlock()
+		slog.Error("Switch failed on every cluster, keeping previous state", "target_prover", target,
+			"duration_ms", elapsed.Milliseconds())
+		if err == nil {
+			err = fmt.Errorf("no cluster switched to prover %d", target)
+		}
+		return err
 	}
+	notServing, probeErr := probeServing(ctx, []int{target})
 
-	log.Printf("Switching to prover %d", target)
+	mu.Lock()
+	defer mu.Unlock()
 
-	other := 1
-	if target == 1 {
-		other = 2
+	from := currentState()
+	lastSwitch = time.Now()
+	recordSwitch(switchEvent{OldProver: currentActiveProver, NewProver: target, Timestamp: lastSwitch, Reason: reason,
+		NotServing: notServing})
+	currentActiveProver = target
+	splitMode = false
+	splitActive = nil
+	markActive(lastSwitch)
+	saveState()
+	switchesTotal.WithLabelValues(strconv.Itoa(target)).Inc()
+	activeProverGauge.Set(float64(target))
+	slog.Info("Prover active", "target_prover", target,
+		"clusters", ok, "total", len(clusters), "duration_ms", elapsed.Milliseconds())
+	logTransition(from, currentState(), reason, ok)
+	return errors.Join(err, probeErr)
+}
+
+// stopAll stops every prover on every cluster, leaving no prover active. The
+// next switch or split starts them again. reason is reported to the webhook.
+// As in switchTo, the clusters stop without mu held.
+func stopAll(ctx context.Context, reason string) error {
+	ctx, done, started := beginSwitch(ctx, "stop all")
+	if !started {
+		return nil
+	}
+	defer done()
+
+	mu.Lock()
+	slog.Info("Stopping all provers", "clusters", len(clusters))
+	cs := slices.Clone(clusters)
+	known := slices.Clone(clusterProvers)
+	held := make([]bool, len(cs))
+	var heldKeys []string
+	for i, c := range cs {
+		if quarantined[clusterKey(c)] {
+			held[i] = true
+			heldKeys = append(heldKeys, clusterKey(c))
+		}
+	}
+	mu.Unlock()
+	if len(heldKeys) > 0 {
+		slog.Warn("Skipping quarantined clusters", "clusters", heldKeys)
 	}
+	start := time.Now()
 
+	errs := make([]error, len(cs))
 	var wg sync.WaitGroup
-	for _, c := range clusters {
+	for i, c := range cs {
+		if held[i] {
+			continue
+		}
 		wg.Add(1)
-
-		go func(cluster Cluster) {
+		go func(idx int, cluster Cluster) {
 			defer wg.Done()
+			select {
+			case sshSem <- struct{}{}:
+				defer func() { <-sshSem }()
+			case <-ctx.Done():
+				errs[idx] = ctx.Err()
+				return
+			}
+			start := time.Now()
+			errs[idx] = errors.Join(drainAndStop(ctx, cluster, known[idx], proverIDs())...)
+			slog.Info("Cluster stop finished", "cluster_ip", cluster.IP, "ok", errs[idx] == nil,
+				"duration_ms", time.Since(start).Milliseconds())
+		}(i, c)
+	}
+	wg.Wait()
 
-			_ = sshDockerCompose(cluster, proverFolders[other], "stop")
-			_ = sshDockerCompose(cluster, proverFolders[target], "start")
-		}(c)
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, clusterKey(cs[i]))
+		}
+	}
+	var err error
+	if len(failed) > 0 {
+		slog.Error("Clusters failed to stop", "failed", len(failed), "total", len(cs), "clusters", failed)
+		err = fmt.Errorf("%d of %d clusters failed to stop: %s", len(failed), len(cs), strings.Join(failed, ", "))
 	}
 
-	wg.Wait()
-	currentActiveProver = target
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i, c := range clusters {
+		if j := slices.IndexFunc(cs, func(s Cluster) bool { return clusterKey(s) == clusterKey(c) }); j >= 0 && !held[j] {
+			// Failed clusters may be running anything, so their state is unknown.
+			clusterProvers[i] = 0
+		}
+	}
+	from := currentState()
+	clear(unfinished)
+	clear(outOfSync)
+	recordSwitch(switchEvent{OldProver: currentActiveProver, Timestamp: time.Now(), Reason: reason})
+	currentActiveProver = 0
 	splitMode = false
-	log.Printf("Prover %d active on all clusters", target)
+	splitActive = nil
+	markActive(time.Now())
+	saveState()
+	activeProverGauge.Set(0)
+	slog.Info("All provers stopped", "total", len(clusters), "duration_ms", time.Since(start).Milliseconds())
+	logTransition(from, currentState(), reason, len(cs)-len(failed)-len(heldKeys))
+	return err
 }
 
-func splitProvers() {
-	mu.Lock()
-	defer mu.Unlock()
+// allocateClusters divides n clusters among provers in proportion to weights
+// using the largest remainder method. When there are at least as many clusters
+// as provers, every prover gets at least one.
+func allocateClusters(n int, weights []int) []int {
+	counts := make([]int, len(weights))
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	if n == 0 || total == 0 {
+		return counts
+	}
 
-	if splitMode {
-		return
+	assigned := 0
+	remainders := make([]int, len(weights))
+	for i, w := range weights {
+		counts[i] = n * w / total
+		remainders[i] = n * w % total
+		assigned += counts[i]
 	}
 
-	mid := len(clusters) / 2
-	log.Printf("Splitting clusters: prover 1 gets %d, prover 2 gets %d", mid, len(clusters)-mid)
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return remainders[b] - remainders[a] })
+	for _, i := range order[:n-assigned] {
+		counts[i]++
+	}
 
-	var wg sync.WaitGroup
+	if n >= len(weights) {
+		for i := range counts {
+			if counts[i] > 0 {
+				continue
+			}
+			largest := 0
+			for j := range counts {
+				if counts[j] > counts[largest] {
+					largest = j
+				}
+			}
+			counts[largest]--
+			counts[i]++
+		}
+	}
+	return counts
+}
+
+// clusterGroups returns the cluster indices of each group, in order of the
+// groups' first appearance. Clusters without a group form a group of their own.
+func clusterGroups() [][]int {
+	var groups [][]int
+	index := map[string]int{}
 	for i, c := range clusters {
-		wg.Add(1)
+		g, ok := index[c.Group]
+		if !ok {
+			g = len(groups)
+			index[c.Group] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
 
-		go func(idx int, cluster Cluster) {
-			defer wg.Done()
+// splitAssignment divides every group of clusters among the active provers in
+// proportion to weights, so no group ends up with a single prover just because
+// of where it sits in the cluster list. Within a group each prover gets a
+// contiguous run of its clusters. It returns the prover assigned to each
+// cluster index.
+func splitAssignment(active, weights []int) []int {
+	assignment := make([]int, len(clusters))
+	for _, members := range clusterGroups() {
+		assignGroup(assignment, members, active, weights)
+	}
+	return assignment
+}
+
+// assignGroup divides the clusters members among active so each prover's
+// share of their total cluster weight is in proportion to weights, writing the
+// result into assignment. The weight is allotted by allocateClusters and each
+// prover takes a contiguous run of clusters until it reaches its allotment,
+// rounding at the middle of the cluster that crosses it, so with every
+// cluster weighing 1 each prover gets exactly its allotted count. As long as
+// there are enough clusters, every prover with an allotment gets one.
+func assignGroup(assignment, members, active, weights []int) {
+	total := 0
+	for _, i := range members {
+		total += clusters[i].Weight
+	}
+	targets := allocateClusters(total, weights)
 
-			if idx < mid {
-				_ = sshDockerCompose(cluster, proverFolders[2], "stop")
-				_ = sshDockerCompose(cluster, proverFolders[1], "start")
-			} else {
-				_ = sshDockerCompose(cluster, proverFolders[1], "stop")
-				_ = sshDockerCompose(cluster, proverFolders[2], "start")
+	next, acc, bound := 0, 0, 0
+	for k, id := range active {
+		if targets[k] == 0 {
+			continue
+		}
+		bound += targets[k]
+		// Clusters to leave for the provers after this one.
+		later := 0
+		for _, t := range targets[k+1:] {
+			if t > 0 {
+				later++
 			}
-		}(i, c)
+		}
+		for taken := 0; next < len(members)-later; taken++ {
+			w := clusters[members[next]].Weight
+			if taken > 0 && 2*acc+w > 2*bound {
+				break
+			}
+			assignment[members[next]] = id
+			acc += w
+			next++
+		}
 	}
+}
 
-	wg.Wait()
+// splitProvers divides the clusters among the active provers in proportion to
+// weights (their order counts), or to splitRatio when one is configured. The
+// allocation is fixed when split mode is entered or its prover set changes;
+// count changes alone don't re-split. reason is reported to the webhook, and
+// errors are reported as by switchProver. As in switchTo, the clusters switch
+// without mu held.
+func splitProvers(ctx context.Context, active, weights []int, reason string) error {
+	ctx, done, started := beginSwitch(ctx, fmt.Sprintf("split %v", active))
+	if !started {
+		slog.Debug("Split across the same provers already in progress", "provers", active)
+		return nil
+	}
+	defer done()
+
+	mu.Lock()
+	if splitMode && slices.Equal(splitActive, active) {
+		mu.Unlock()
+		return nil
+	}
+	if remaining := cooldownRemaining(); remaining > 0 {
+		mu.Unlock()
+		slog.Info("Switch cooldown active, not splitting",
+			"provers", active, "remaining", remaining.Round(time.Second).String())
+		return nil
+	}
+
+	if len(splitRatio) > 0 {
+		weights = make([]int, len(active))
+		for k, id := range active {
+			weights[k] = splitRatio[id-1]
+		}
+	}
+	assignment := splitAssignment(active, weights)
+	counts := make([]int, len(active))
+	capacity := make([]int, len(active))
+	for i, id := range assignment {
+		counts[slices.Index(active, id)]++
+		capacity[slices.Index(active, id)] += clusters[i].Weight
+	}
+	b := newSwitchBatch(assignment)
+	mu.Unlock()
+	slog.Info("Splitting clusters", "provers", active, "weights", weights, "allocation", counts,
+		"allocation_weight", capacity)
+	start := time.Now()
+
+	ok, err := applyWithDeadline(ctx, b)
+	elapsed := time.Since(start)
+	switchDuration.WithLabelValues("split").Observe(elapsed.Seconds())
+	if ok == 0 {
+		mu.Lock()
+		clear(unfinished)
+		dropOutOfSync(b)
+		mu.Unlock()
+		slog.Error("Split failed on every cluster, keeping previous state", "provers", active,
+			"duration_ms", elapsed.Milliseconds())
+		if err == nil {
+			err = fmt.Errorf("no cluster switched to split %v", active)
+		}
+		return err
+	}
+	notServing, probeErr := probeServing(ctx, active)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	from := currentState()
+	lastSwitch = time.Now()
+	recordSwitch(switchEvent{
+		OldProver:    currentActiveProver,
+		SplitMode:    true,
+		SplitProvers: active,
+		Timestamp:    lastSwitch,
+		Reason:       reason,
+		NotServing:   notServing,
+	})
 	splitMode = true
+	splitActive = slices.Clone(active)
 	currentActiveProver = 0
-	log.Printf("Split mode active: clusters 0-%d → prover 1, clusters %d-%d → prover 2",
-		mid-1, mid, len(clusters)-1)
+	markActive(lastSwitch)
+	saveState()
+	splitActivationsTotal.Inc()
+	activeProverGauge.Set(0)
+
+	var parts []string
+	for _, id := range active {
+		var idx []string
+		for i, p := range assignment {
+			if p == id {
+				idx = append(idx, strconv.Itoa(i))
+			}
+		}
+		parts = append(parts, fmt.Sprintf("clusters %s → prover %d", strings.Join(idx, ","), id))
+	}
+	slog.Info("Split mode active", "assignment", strings.Join(parts, ", "),
+		"clusters", ok, "total", len(clusters), "duration_ms", elapsed.Milliseconds())
+	logTransition(from, currentState(), reason, ok)
+	return errors.Join(err, probeErr)
+}
+
+// currentProvers returns the provers currently running: the split set in split
+// mode, otherwise the single active prover, or nil if none is active.
+func currentProvers() []int {
+	return snapshotState().provers()
 }
 
-func checkOrder(url string) (bool, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return false, err
+// debounced reports whether target (the provers with orders) has been observed
+// for switchDebounce consecutive polls and should now be applied. Observing
+// anything else resets the count. The first activation after startup is not
+// delayed since there is nothing to flap away from.
+func debounced(target []int) bool {
+	current := currentProvers()
+	if slices.Equal(current, target) {
+		pendingTarget, pendingCount = nil, 0
+		return false
+	}
+	if current == nil {
+		return true
 	}
-	defer resp.Body.Close()
 
-	var order AssignedOrder
-	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
-		return false, err
+	if !slices.Equal(pendingTarget, target) {
+		pendingTarget, pendingCount = slices.Clone(target), 0
+	}
+	pendingCount++
+	if pendingCount < switchDebounce {
+		slog.Info("Switch pending", "provers", target, "polls", pendingCount, "required", switchDebounce)
+		return false
 	}
 
-	return order.OrderExists, nil
+	pendingTarget, pendingCount = nil, 0
+	return true
 }
 
-func main() {
-	mustLoadEnv()
+// State is an operating state of the fleet: one prover everywhere, a split
+// across several, or no prover at all.
+type State struct {
+	Prover int   // the prover on every cluster, if not split
+	Split  []int // the split provers, in ID order
+}
+
+// currentState returns the state the globals describe. Callers must hold mu.
+func currentState() State {
+	if splitMode {
+		return State{Split: slices.Clone(splitActive)}
+	}
+	return State{Prover: currentActiveProver}
+}
+
+// snapshotState is currentState for callers that don't hold mu. The result
+// shares nothing with the globals, so it stays valid however they change.
+func snapshotState() State {
+	mu.Lock()
+	defer mu.Unlock()
+	return currentState()
+}
+
+// mode is "split", "single" or "none".
+func (s State) mode() string {
+	switch {
+	case len(s.Split) > 0:
+		return "split"
+	case s.Prover != 0:
+		return "single"
+	default:
+		return "none"
+	}
+}
+
+// describe summarizes s for log lines.
+func (s State) describe() string {
+	switch s.mode() {
+	case "split":
+		return fmt.Sprintf("split mode across provers %v", s.Split)
+	case "single":
+		return fmt.Sprintf("prover %d active", s.Prover)
+	default:
+		return "no prover active"
+	}
+}
+
+func (s State) String() string {
+	switch s.mode() {
+	case "split":
+		return fmt.Sprintf("split %v", s.Split)
+	case "single":
+		return fmt.Sprintf("prover %d", s.Prover)
+	default:
+		return "none"
+	}
+}
+
+// provers returns the provers running in s.
+func (s State) provers() []int {
+	if s.Prover != 0 {
+		return []int{s.Prover}
+	}
+	return s.Split
+}
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+// markActive updates activeSince after a change of state at now: provers that
+// just became active start counting from now, provers that stayed active keep
+// their time, and the rest are dropped. Callers must hold mu.
+func markActive(now time.Time) {
+	running := currentState().provers()
+	for id := range activeSince {
+		if !slices.Contains(running, id) {
+			delete(activeSince, id)
+		}
+	}
+	for _, id := range running {
+		if _, ok := activeSince[id]; !ok {
+			activeSince[id] = now
+		}
+	}
+}
+
+// logTransition writes the one line that records every change of operating
+// state, so transitions can be followed by a single message.
+func logTransition(from, to State, reason string, clusters int) {
+	slog.Info("State transition",
+		"transition", from.mode()+"→"+to.mode(),
+		"from", from.String(), "to", to.String(),
+		"reason", reason, "clusters", clusters)
+}
 
-	for range ticker.C {
-		order1, err1 := checkOrder(apiEndpoint + "?prover=" + prover1Address)
-		order2, err2 := checkOrder(apiEndpoint + "?prover=" + prover2Address)
+// Action is what a poll cycle decided to do with the clusters.
+type Action int
 
-		if err1 != nil || err2 != nil {
-			log.Printf(
-				"Endpoint error (err1=%v err2=%v) — defaulting to prover 1",
-				err1, err2,
-			)
-			switchProver(1)
+const (
+	// KeepCurrent leaves the clusters alone because no prover has orders.
+	KeepCurrent Action = iota
+	// SwitchTo moves every cluster to the one prover with orders.
+	SwitchTo
+	// Split divides the clusters among the provers with orders.
+	Split
+	// FallbackDefault moves every cluster to fallbackProver because the order
+	// API failed.
+	FallbackDefault
+)
+
+func (a Action) String() string {
+	switch a {
+	case KeepCurrent:
+		return "keep current"
+	case SwitchTo:
+		return "switch"
+	case Split:
+		return "split"
+	case FallbackDefault:
+		return "fallback"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+type decision struct {
+	Action  Action
+	Provers []int // the provers to run, in ID order
+	Weights []int // split weights, parallel to Provers
+	// Contenders are the provers with orders a tie-break chose Provers from
+	// because splitting is disabled.
+	Contenders []int
+}
+
+// decideAction turns one poll's results into an action. If every check
+// failed, or any did and fallbackOnAny is set, the order picture is unknown
+// and the fallback prover wins over every order that was seen. Otherwise
+// provers whose check failed are left out and the rest decide. Only
+// provers with more than splitMin orders take part in a split, and at most
+// maxSplit of them (one per cluster), the busiest first with ties going to the
+// lower ID; if fewer than two qualify, the prover with the most orders gets
+// every cluster. With noSplit there is never a split: of several provers with
+// orders, the one with the highest priority wins, then the one with the most
+// orders, then the lower ID.
+func decideAction(ids []int, orders map[int]AssignedOrder, errs map[int]error, splitMin, maxSplit int, fallbackOnAny, noSplit bool) decision {
+	if len(errs) > 0 && (fallbackOnAny || len(errs) >= len(ids)) {
+		return decision{Action: FallbackDefault}
+	}
+
+	var d decision
+	busiest := 0
+	var contenders []int
+	for _, id := range ids {
+		if errs[id] != nil {
 			continue
 		}
+		order := orders[id]
+		if !order.OrderExists {
+			continue
+		}
+		contenders = append(contenders, id)
+		if busiest == 0 || order.weight() > orders[busiest].weight() {
+			busiest = id
+		}
+		if order.weight() > splitMin {
+			d.Provers = append(d.Provers, id)
+			d.Weights = append(d.Weights, order.weight())
+		}
+	}
+
+	if noSplit && len(contenders) > 1 {
+		pick := contenders[0]
+		for _, id := range contenders[1:] {
+			o, p := orders[id], orders[pick]
+			if o.Priority > p.Priority || (o.Priority == p.Priority && o.weight() > p.weight()) {
+				pick = id
+			}
+		}
+		return decision{Action: SwitchTo, Provers: []int{pick}, Weights: []int{orders[pick].weight()}, Contenders: contenders}
+	}
+
+	if len(d.Provers) > maxSplit {
+		// Keep the busiest; the stable sort leaves ties in ID order.
+		order := make([]int, len(d.Provers))
+		for k := range order {
+			order[k] = k
+		}
+		slices.SortStableFunc(order, func(a, b int) int { return d.Weights[b] - d.Weights[a] })
+		order = order[:max(maxSplit, 0)]
+		slices.Sort(order)
+		var provers, weights []int
+		for _, k := range order {
+			provers = append(provers, d.Provers[k])
+			weights = append(weights, d.Weights[k])
+		}
+		d.Provers, d.Weights = provers, weights
+	}
+
+	switch {
+	case busiest == 0:
+		return decision{Action: KeepCurrent}
+	case len(d.Provers) < 2:
+		return decision{Action: SwitchTo, Provers: []int{busiest}, Weights: []int{orders[busiest].weight()}}
+	default:
+		d.Action = Split
+		return d
+	}
+}
+
+// logTieBreak reports the prover d picked among several with orders because
+// splitting is disabled: at info level when it changes what runs, otherwise at
+// debug so a steady state doesn't log every poll. group is "" for the fleet.
+func logTieBreak(ctx context.Context, group string, d decision, orders map[int]AssignedOrder, current []int) {
+	level := slog.LevelInfo
+	if slices.Equal(current, d.Provers) {
+		level = slog.LevelDebug
+	}
+	priorities := make(map[int]int, len(d.Contenders))
+	counts := make(map[int]int, len(d.Contenders))
+	for _, id := range d.Contenders {
+		priorities[id], counts[id] = orders[id].Priority, orders[id].weight()
+	}
+	attrs := []any{"prover", d.Provers[0], "contenders", d.Contenders, "priorities", priorities, "orders", counts}
+	if group != "" {
+		attrs = append(attrs, "group", group)
+	}
+	slog.Log(ctx, level, "Split disabled, tie-break picked one prover", attrs...)
+}
+
+// runOnce polls every prover for orders and switches or splits the clusters
+// to match. The error reports failed order checks and clusters that failed
+// to switch; either way the cycle has already acted on what it saw.
+func runOnce(ctx context.Context) error {
+	if forceSplit {
+		return runForcedSplit(ctx)
+	}
+	if remaining := breakerRemaining(); remaining > 0 {
+		slog.Debug("Order API circuit breaker open, skipping poll",
+			"remaining", remaining.Round(time.Second).String())
+		markPollCompleted()
+		return nil
+	}
+	if orderSourceMode == orderSourceGroup {
+		return runGroups(ctx)
+	}
+
+	ids := proverIDs()
+	orders, pollErrs := pollOrders(ctx)
+
+	var errs []string
+	timedOut := false
+	polled := time.Now()
+	results := make([]orderResult, len(ids))
+	for i, id := range ids {
+		err := pollErrs[id]
+		results[i] = newOrderResult(id, "", orders[id], err, polled)
+		recordPoll(id, orders[id].OrderExists, err)
+		if err != nil {
+			orderCheckErrorsTotal.WithLabelValues(strconv.Itoa(id)).Inc()
+			errs = append(errs, fmt.Sprintf("prover %d: %v", id, err))
+			timedOut = timedOut || errors.Is(err, errAPITimeout)
+		}
+	}
+
+	recordOrders(results)
+
+	var pollErr error
+	if len(errs) > 0 {
+		pollErr = fmt.Errorf("order checks failed: %s", strings.Join(errs, "; "))
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	recordPollOutcome(pollErr != nil)
+
+	if prover, remaining := activeOverride(); prover != 0 {
+		slog.Debug("Override active, ignoring orders",
+			"prover", prover, "remaining", remaining.Round(time.Second).String())
+		markPollCompleted()
+		return pollErr
+	}
+
+	mu.Lock()
+	n := len(clusters)
+	mu.Unlock()
+	d := decideAction(ids, orders, pollErrs, splitMinOrders, n, fallbackPolicy == fallbackAnyFailed, disableSplit)
+	if len(d.Contenders) > 0 {
+		logTieBreak(ctx, "", d, orders, currentProvers())
+	}
+	if len(errs) > 0 && d.Action != FallbackDefault {
+		slog.Warn("Some order checks failed, deciding on the rest", "errors", errs)
+	}
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		signals := make(map[int]int, len(ids))
+		for _, id := range ids {
+			if orders[id].OrderExists {
+				signals[id] = orders[id].weight()
+			} else if pollErrs[id] == nil {
+				signals[id] = 0
+			}
+		}
+		current := currentProvers()
+		action := d.Action.String()
+		if d.Action == KeepCurrent || slices.Equal(current, d.Provers) {
+			action = "no change"
+		}
+		slog.Debug("Poll decision", "orders", signals, "failed_checks", len(errs),
+			"action", action, "provers", d.Provers, "current", current)
+	}
+	if inMaintenance(time.Now()) {
+		slog.Info("Maintenance window, holding current state",
+			"would", d.Action.String(), "provers", d.Provers, "errors", errs)
+		markPollCompleted()
+		return pollErr
+	}
+	if d.Action != KeepCurrent {
+		idleSince = time.Time{}
+	}
+	var switchErr error
+	switch {
+	case d.Action == FallbackDefault:
+		kind := "error"
+		if timedOut {
+			kind = "timeout"
+		}
+		slog.Warn("Order endpoint failed, switching to fallback prover",
+			"fallback_prover", fallbackProver, "kind", kind, "errors", errs)
+		switchErr = switchProver(ctx, fallbackProver, "fallback")
+	case d.Action == KeepCurrent:
+		pendingTarget, pendingCount = nil, 0
+		if pollErr != nil {
+			// A prover that couldn't be checked may have orders.
+			slog.Info("No orders from the provers checked, keeping current prover")
+			break
+		}
+		if idle, due := idleShutdownDue(); due {
+			slog.Info("No orders for the idle shutdown period, stopping all provers",
+				"idle", idle.Round(time.Second).String())
+			switchErr = stopAll(ctx, "idle")
+			break
+		}
+		slog.Info("No orders, keeping current prover")
+		switchErr = resumeSwitch(ctx)
+	case slices.Equal(currentProvers(), d.Provers):
+		pendingTarget, pendingCount = nil, 0
+		switchErr = resumeSwitch(ctx)
+	case !debounced(d.Provers):
+	case d.Action == SwitchTo:
+		switchErr = switchProver(ctx, d.Provers[0], "orders")
+	case d.Action == Split:
+		switchErr = splitProvers(ctx, d.Provers, d.Weights, "orders")
+	}
+	markPollCompleted()
+	return errors.Join(pollErr, switchErr)
+}
+
+// idleShutdownDue counts a poll without orders towards idle shutdown and
+// reports how long there have been none and whether every prover should now
+// be stopped.
+func idleShutdownDue() (time.Duration, bool) {
+	if idleSince.IsZero() {
+		idleSince = time.Now()
+	}
+	idle := time.Since(idleSince)
+	return idle, idleShutdown > 0 && idle >= idleShutdown && currentProvers() != nil
+}
+
+// runForcedSplit keeps the clusters split evenly, or by splitRatio, across
+// every prover without asking the order API. An override still takes
+// precedence, and the split is restored once it ends.
+func runForcedSplit(ctx context.Context) error {
+	defer markPollCompleted()
+	if prover, remaining := activeOverride(); prover != 0 {
+		slog.Debug("Override active, not splitting",
+			"prover", prover, "remaining", remaining.Round(time.Second).String())
+		return nil
+	}
+
+	ids := proverIDs()
+	mu.Lock()
+	// With fewer clusters than provers the last provers would get none.
+	ids = ids[:min(len(ids), len(clusters))]
+	mu.Unlock()
+	if len(ids) == 1 {
+		return switchProver(ctx, ids[0], "force_split")
+	}
+	weights := make([]int, len(ids))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return splitProvers(ctx, ids, weights, "force_split")
+}
+
+// nextPollDelay returns pollInterval moved randomly by up to pollJitter of
+// itself in either direction, so bidders started together drift apart instead
+// of hitting the order API in lockstep.
+func nextPollDelay() time.Duration {
+	spread := float64(pollInterval) * pollJitter
+	return pollInterval + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to a YAML, TOML (.toml) or JSON (.json) config file (env vars override its values)")
+	dryRunFlag := flag.Bool("dry-run", false, "log docker compose commands instead of running them")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	validate := flag.Bool("validate", false, "check the config, print a summary of it and exit")
+	once := flag.Bool("once", false, "poll once, apply the resulting switch and exit non-zero on any failure")
+	checkFlag := flag.Bool("check-clusters", false, "check SSH access to every cluster, print the results and exit")
+	pprofFlag := flag.Bool("pprof", false, "serve net/http/pprof profiles under /debug/pprof/ on the status port")
+	jsonFlag := flag.Bool("json", false, "print the output of -version, -validate and -check-clusters as JSON")
+	flag.Parse()
+
+	if *showVersion {
+		if *jsonFlag {
+			writeJSON(os.Stdout, versionInfo{Version: version, Commit: commit, BuildDate: buildDate})
+			return
+		}
+		fmt.Printf("bidder %s\n", versionString())
+		return
+	}
 
-		switch {
-		case order1 && order2:
-			splitProvers()
-		case order1 && !order2:
-			switchProver(1)
-		case order2 && !order1:
-			switchProver(2)
-		default:
-			log.Println("No orders — keeping current prover")
+	if *validate {
+		cfg, err := loadConfig(*configPath)
+		if *jsonFlag {
+			type validation struct {
+				Valid  bool   `json:"valid"`
+				Error  string `json:"error,omitempty"`
+				Config any    `json:"config,omitempty"`
+			}
+			if err != nil {
+				writeJSON(os.Stdout, validation{Error: err.Error()})
+				os.Exit(1)
+			}
+			v, err := configJSON(cfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			writeJSON(os.Stdout, validation{Valid: true, Config: v})
+			return
 		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+			os.Exit(1)
+		}
+		printConfig(os.Stdout, cfg)
+		return
+	}
+
+	if err := setupLogging(os.Getenv("LOG_LEVEL")); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadEnv(*configPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if *checkFlag {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		ok := checkClusters(ctx, os.Stdout, *jsonFlag)
+		closePool()
+		stop()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	dryRun = dryRun || *dryRunFlag
+	pprofEnabled = pprofEnabled || *pprofFlag
+	if dryRun {
+		slog.Warn("Dry run: docker compose commands will be logged, not executed, and state will not be saved")
+	} else {
+		loadState()
+	}
+
+	if forceSplit {
+		slog.Warn("FORCE_SPLIT is set: ignoring the order API and splitting every cluster across all provers. For capacity testing only")
+	}
+	slog.Info("Starting bidder", "version", version, "commit", commit,
+		"poll_interval", pollInterval.String(), "poll_jitter", pollJitter,
+		"clusters", len(clusters), "provers", len(proverFolders))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *once {
+		// Each run starts with no debounce history, so act on this poll alone.
+		switchDebounce = 1
+		err := runOnce(ctx)
+		closePool()
+		webhooksPending.Wait()
+		state := snapshotState().describe()
+		if err != nil {
+			slog.Error("Run failed", "state", state, "error", err)
+			stop()
+			os.Exit(1)
+		}
+		slog.Info("Run complete", "state", state)
+		return
+	}
+
+	srv := startStatusServer(statusPort)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	if stallTimeout > 0 {
+		go watchStall(ctx)
+	}
+	runOnce(ctx)
+	if healthCheckInterval > 0 {
+		go watchProvers(ctx)
+	}
+	go reconcileLoop(ctx)
+
+	timer := time.NewTimer(nextPollDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Switches on this goroutine run synchronously and were aborted
+			// by ctx, so none is in flight by the time we get here.
+			slog.Info("Shutting down", "state", snapshotState().describe())
+			if stopOnExit {
+				// A second signal now kills the process instead of waiting.
+				stop()
+				slog.Info("STOP_ON_EXIT is set, stopping all provers before exiting")
+				if err := stopAll(context.Background(), "shutdown"); err != nil {
+					slog.Error("Not every prover stopped", "error", err)
+				}
+				webhooksPending.Wait()
+			}
+			shutdownServer(srv)
+			closePool()
+			return
+		case <-hup:
+			reloadConfig(ctx, *configPath)
+			// A reload's switch is bounded by switchDeadline like a poll's,
+			// so finishing one counts as the loop making progress.
+			markPollCompleted()
+			continue
+		case <-timer.C:
+		}
+
+		runOnce(ctx)
+		timer.Reset(nextPollDelay())
 	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Prover poll outcomes for decideAction tables.
+const (
+	none = iota
+	order
+	failed
+)
+
+func TestDecideActionTwoProvers(t *testing.T) {
+	split := decision{Action: Split, Provers: []int{1, 2}, Weights: []int{1, 1}}
+	only := func(id int) decision {
+		return decision{Action: SwitchTo, Provers: []int{id}, Weights: []int{1}}
+	}
+	keep := decision{Action: KeepCurrent}
+	fallback := decision{Action: FallbackDefault}
+
+	tests := []struct {
+		p1, p2        int
+		want, wantAny decision // with fallbackOnAny unset and set
+	}{
+		{none, none, keep, keep},
+		{order, none, only(1), only(1)},
+		{none, order, only(2), only(2)},
+		{order, order, split, split},
+		{failed, none, keep, fallback},
+		{none, failed, keep, fallback},
+		{failed, order, only(2), fallback},
+		{order, failed, only(1), fallback},
+		{failed, failed, fallback, fallback},
+	}
+	names := []string{"none", "order", "failed"}
+	for _, tt := range tests {
+		orders := map[int]AssignedOrder{}
+		errs := map[int]error{}
+		for id, outcome := range map[int]int{1: tt.p1, 2: tt.p2} {
+			switch outcome {
+			case order:
+				orders[id] = AssignedOrder{OrderExists: true}
+			case failed:
+				errs[id] = errors.New("API down")
+			}
+		}
+		for _, any := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/%s/any=%v", names[tt.p1], names[tt.p2], any), func(t *testing.T) {
+				want := tt.want
+				if any {
+					want = tt.wantAny
+				}
+				got := decideAction([]int{1, 2}, orders, errs, 0, 2, any, false)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("got %+v, want %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestDecideActionPolicy(t *testing.T) {
+	counts := func(c ...int) map[int]AssignedOrder {
+		orders := map[int]AssignedOrder{}
+		for i, n := range c {
+			if n > 0 {
+				orders[i+1] = AssignedOrder{OrderExists: true, Count: n}
+			}
+		}
+		return orders
+	}
+
+	tests := []struct {
+		name     string
+		ids      []int
+		orders   map[int]AssignedOrder
+		splitMin int
+		maxSplit int
+		noSplit  bool
+		want     decision
+	}{
+		{
+			name: "split weighted by count", ids: []int{1, 2}, orders: counts(3, 1), maxSplit: 4,
+			want: decision{Action: Split, Provers: []int{1, 2}, Weights: []int{3, 1}},
+		},
+		{
+			name: "splitMin leaves one, which gets everything", ids: []int{1, 2}, orders: counts(3, 1), splitMin: 1, maxSplit: 4,
+			want: decision{Action: SwitchTo, Provers: []int{1}, Weights: []int{3}},
+		},
+		{
+			name: "nobody above splitMin goes to the busiest", ids: []int{1, 2}, orders: counts(1, 2), splitMin: 5, maxSplit: 4,
+			want: decision{Action: SwitchTo, Provers: []int{2}, Weights: []int{2}},
+		},
+		{
+			name: "maxSplit keeps the busiest", ids: []int{1, 2, 3}, orders: counts(1, 5, 3), maxSplit: 2,
+			want: decision{Action: Split, Provers: []int{2, 3}, Weights: []int{5, 3}},
+		},
+		{
+			name: "maxSplit ties go to the lower ID", ids: []int{1, 2, 3}, orders: counts(2, 2, 2), maxSplit: 2,
+			want: decision{Action: Split, Provers: []int{1, 2}, Weights: []int{2, 2}},
+		},
+		{
+			name: "maxSplit of one switches to the busiest", ids: []int{1, 2}, orders: counts(2, 4), maxSplit: 1,
+			want: decision{Action: SwitchTo, Provers: []int{2}, Weights: []int{4}},
+		},
+		{
+			name: "noSplit picks the most orders", ids: []int{1, 2}, orders: counts(2, 4), maxSplit: 4, noSplit: true,
+			want: decision{Action: SwitchTo, Provers: []int{2}, Weights: []int{4}, Contenders: []int{1, 2}},
+		},
+		{
+			name: "noSplit picks priority over orders", ids: []int{1, 2},
+			orders: map[int]AssignedOrder{
+				1: {OrderExists: true, Count: 9},
+				2: {OrderExists: true, Count: 1, Priority: 1},
+			},
+			maxSplit: 4, noSplit: true,
+			want: decision{Action: SwitchTo, Provers: []int{2}, Weights: []int{1}, Contenders: []int{1, 2}},
+		},
+		{
+			name: "noSplit ties go to the lower ID", ids: []int{1, 2, 3}, orders: counts(0, 3, 3), maxSplit: 4, noSplit: true,
+			want: decision{Action: SwitchTo, Provers: []int{2}, Weights: []int{3}, Contenders: []int{2, 3}},
+		},
+		{
+			name: "noSplit with one prover busy is no tie-break", ids: []int{1, 2}, orders: counts(0, 3), maxSplit: 4, noSplit: true,
+			want: decision{Action: SwitchTo, Provers: []int{2}, Weights: []int{3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decideAction(tt.ids, tt.orders, nil, tt.splitMin, tt.maxSplit, false, tt.noSplit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a recurring UTC time range, every day or on one
+// weekday. A range that ends before it starts runs past midnight.
+type maintenanceWindow struct {
+	day        time.Weekday
+	everyDay   bool
+	start, end int // minutes since midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseMaintenanceWindows parses entries like "02:00-04:00" or
+// "Sat 22:00-02:00".
+func parseMaintenanceWindows(entries []string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, entry := range entries {
+		w := maintenanceWindow{everyDay: true}
+		span := entry
+		if day, rest, ok := strings.Cut(entry, " "); ok {
+			d, known := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+			if !known {
+				return nil, fmt.Errorf("MAINTENANCE_WINDOWS: unknown weekday in %q", entry)
+			}
+			w.day, w.everyDay, span = d, false, strings.TrimSpace(rest)
+		}
+
+		from, to, ok := strings.Cut(span, "-")
+		start, err1 := time.Parse("15:04", from)
+		end, err2 := time.Parse("15:04", to)
+		if !ok || err1 != nil || err2 != nil || start.Equal(end) {
+			return nil, fmt.Errorf("MAINTENANCE_WINDOWS: %q is not a range like 02:00-04:00", entry)
+		}
+		w.start = start.Hour()*60 + start.Minute()
+		w.end = end.Hour()*60 + end.Minute()
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return (w.everyDay || t.Weekday() == w.day) && m >= w.start && m < w.end
+	}
+	// Past midnight: the window started today or the day before.
+	yesterday := t.AddDate(0, 0, -1).Weekday()
+	return (m >= w.start && (w.everyDay || t.Weekday() == w.day)) ||
+		(m < w.end && (w.everyDay || yesterday == w.day))
+}
+
+// inMaintenance reports whether t falls in any maintenance window.
+func inMaintenance(t time.Time) bool {
+	for _, w := range maintenanceWindows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
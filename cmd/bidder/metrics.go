@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	switchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bidder_prover_switches_total",
+		Help: "Completed switches of all clusters to a single prover.",
+	}, []string{"target"})
+
+	splitActivationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bidder_split_activations_total",
+		Help: "Completed activations of split mode.",
+	})
+
+	sshFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bidder_ssh_failures_total",
+		Help: "Remote docker compose commands that failed.",
+	}, []string{"cluster", "action"})
+
+	sshAuthFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bidder_ssh_auth_failures_total",
+		Help: "Remote commands that failed because a cluster rejected our credentials or we rejected its host key.",
+	}, []string{"cluster"})
+
+	clusterSwitchFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bidder_cluster_switch_failures_total",
+		Help: "Clusters that failed to reach their assigned prover during a switch.",
+	})
+
+	verifyFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bidder_verify_failures_total",
+		Help: "Started provers whose containers were not all running afterwards.",
+	}, []string{"cluster"})
+
+	orderCheckErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bidder_order_check_errors_total",
+		Help: "Order API checks that failed after all retries.",
+	}, []string{"prover"})
+
+	proverRestartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bidder_prover_restarts_total",
+		Help: "Restarts of an active prover found not running by the health check.",
+	}, []string{"cluster"})
+
+	webhookFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bidder_webhook_failures_total",
+		Help: "Switch webhook deliveries that failed.",
+	})
+
+	hookFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bidder_post_switch_hook_failures_total",
+		Help: "Post-switch hook runs that failed or timed out.",
+	})
+
+	switchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bidder_switch_duration_seconds",
+		Help:    "Wall-clock time to apply a switch or split across all clusters, successful or not.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"mode"})
+
+	servingProbeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bidder_serving_probe_seconds",
+		Help:    "Time from the end of a switch until the new prover's serving probe reported ready.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"prover"})
+
+	servingProbeFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bidder_serving_probe_failures_total",
+		Help: "Switched-to provers that never reported ready to the serving probe.",
+	})
+
+	breakerOpenGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bidder_api_breaker_open",
+		Help: "1 while the order API circuit breaker is open or probing, 0 when closed.",
+	})
+
+	activeProverGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bidder_active_prover",
+		Help: "Prover active on all clusters, or 0 in split mode or before the first switch.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bidder_seconds_since_last_order",
+		Help: "Seconds since any prover last had an assigned order, counted from startup until the first.",
+	}, func() float64 { return sinceLastOrder().Seconds() })
+)
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	apiRetryBaseDelay = 250 * time.Millisecond
+	// maxErrorBody bounds how much of an error response is kept for logs.
+	maxErrorBody = 256
+)
+
+// errBatchUnsupported is returned by checkOrders when the API has no batch
+// endpoint.
+var errBatchUnsupported = errors.New("batch order endpoint not found")
+
+// errAPITimeout distinguishes a slow or hung order API from one that refused
+// the connection or returned a bad response.
+var errAPITimeout = errors.New("order API timed out")
+
+// AssignedOrder is the order API response for one prover. Fields the API
+// doesn't send are left at their zero values.
+type AssignedOrder struct {
+	OrderExists             bool      `json:"assigned"`
+	Count                   int       `json:"count"`
+	Priority                int       `json:"priority"`
+	Deadline                time.Time `json:"deadline"`
+	EstimatedProvingSeconds int       `json:"estimated_proving_seconds"`
+}
+
+// weight is the share of clusters this prover should get in split mode. APIs
+// that don't report a count weigh every assigned prover equally.
+func (o AssignedOrder) weight() int {
+	return max(o.Count, 1)
+}
+
+// APIError reports a non-2xx response from the order API.
+type APIError struct {
+	Endpoint   string // the URL requested, without its query
+	StatusCode int
+	Body       string // the start of the response body
+	RequestID  string // the X-Request-ID sent
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("order API returned %d: %s (request %s)", e.StatusCode, e.Body, e.RequestID)
+}
+
+// newRequestID returns a random ID for the X-Request-ID header, so a failed
+// request can be found in the API's own logs.
+func newRequestID() string {
+	b := make([]byte, 16)
+	cryptorand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newAPIClient builds the order API client, trusting cfg.APICACert in
+// addition to the system roots. Requests go through cfg.APIProxy if set, or
+// else the proxy named by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newAPIClient(cfg *Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.APIProxy != "" {
+		proxy, err := url.Parse(cfg.APIProxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("API_PROXY_URL: not a proxy URL: %q", cfg.APIProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if cfg.APICACert != "" || cfg.APIInsecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: cfg.APIInsecure}
+	}
+
+	if cfg.APICACert != "" {
+		pem, err := os.ReadFile(expandHome(cfg.APICACert))
+		if err != nil {
+			return nil, fmt.Errorf("API_CA_CERT: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("API_CA_CERT: no PEM certificates in %s", cfg.APICACert)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+
+	return &http.Client{Timeout: cfg.APITimeout, Transport: transport}, nil
+}
+
+// effectiveProxy describes the proxy client uses to reach endpoint, with any
+// password redacted.
+func effectiveProxy(client *http.Client, endpoint string) string {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return "none"
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "unknown"
+	}
+	proxy, err := transport.Proxy(req)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("invalid (%v)", err)
+	case proxy == nil:
+		return "none"
+	default:
+		return proxy.Redacted()
+	}
+}
+
+// setAPIHeaders adds the order API's User-Agent, token and a new X-Request-ID
+// to req, returning the request ID.
+func setAPIHeaders(req *http.Request) string {
+	id := newRequestID()
+	req.Header.Set("User-Agent", apiUserAgent)
+	req.Header.Set("X-Request-ID", id)
+	if apiToken != "" {
+		// Never log the request or its headers: they carry the token.
+		if strings.EqualFold(apiTokenHeader, "Authorization") {
+			req.Header.Set("Authorization", "Bearer "+apiToken)
+		} else {
+			req.Header.Set(apiTokenHeader, apiToken)
+		}
+	}
+	return id
+}
+
+// getJSON fetches url and decodes the JSON response body into v. Errors
+// carry the request's X-Request-ID.
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	id := setAPIHeaders(req)
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return fmt.Errorf("%w: %v (request %s)", errAPITimeout, err, id)
+		}
+		return fmt.Errorf("%w (request %s)", err, id)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+		body := strings.TrimSpace(string(snippet[:min(len(snippet), maxErrorBody)]))
+		if len(snippet) > maxErrorBody {
+			body += "…"
+		}
+		endpoint, _, _ := strings.Cut(url, "?")
+		return &APIError{Endpoint: endpoint, StatusCode: resp.StatusCode, Body: body, RequestID: id}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %w (request %s)", err, id)
+	}
+	return nil
+}
+
+func checkOrder(ctx context.Context, url string) (AssignedOrder, error) {
+	var order AssignedOrder
+	if err := getJSON(ctx, url, &order); err != nil {
+		return AssignedOrder{}, err
+	}
+	return order, nil
+}
+
+// checkGroupOrders asks the order API at endpoint for the orders of group's
+// clusters. The response is keyed by prover address like the batch endpoint's,
+// and provers missing from it have no order.
+func checkGroupOrders(ctx context.Context, endpoint, group string) (map[string]AssignedOrder, error) {
+	var orders map[string]AssignedOrder
+	if err := getJSON(ctx, endpoint+"?group="+url.QueryEscape(group), &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// checkOrders queries the batch endpoint for every address in one request.
+// It returns errBatchUnsupported if the endpoint responds 404. Addresses
+// missing from the response are treated as having no order.
+func checkOrders(ctx context.Context, addresses []string) (map[string]AssignedOrder, error) {
+	var orders map[string]AssignedOrder
+	err := getJSON(ctx, apiBatchEndpoint+"?provers="+strings.Join(addresses, ","), &orders)
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, errBatchUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// withRetry calls fn up to apiRetries times with exponential backoff and
+// jitter, returning the last error if every attempt fails.
+func withRetry(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < apiRetries; attempt++ {
+		if attempt > 0 {
+			backoff := apiRetryBaseDelay << (attempt - 1)
+			backoff += time.Duration(rand.Int64N(int64(backoff)))
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		err = fn()
+		if err == nil || ctx.Err() != nil || errors.Is(err, errBatchUnsupported) {
+			return err
+		}
+		slog.Warn("Order check failed", "attempt", attempt+1, "max_attempts", apiRetries, "error", err)
+	}
+	return err
+}
+
+// OrderSource reports whether provers have an order assigned, by address.
+type OrderSource interface {
+	// HasOrder reports whether the prover at addr has an order assigned.
+	HasOrder(ctx context.Context, addr string) (bool, error)
+}
+
+// BatchOrderSource is an OrderSource that can also be asked about every
+// prover at once, rather than one at a time, so it can answer a whole poll in
+// one request, as the batch endpoint does, and every answer describes the
+// same moment. pollOrders uses Orders when the source has it.
+type BatchOrderSource interface {
+	OrderSource
+	// Orders returns the order status of each address. Addresses that could
+	// not be checked have an entry in errs instead.
+	Orders(ctx context.Context, addrs []string) (orders map[string]AssignedOrder, errs map[string]error)
+}
+
+// GroupOrderSource reports the order status of provers within a cluster
+// group, for ORDER_SOURCE=group.
+type GroupOrderSource interface {
+	// GroupOrders returns the order status of each prover, by address, for
+	// group's clusters.
+	GroupOrders(ctx context.Context, group string) (map[string]AssignedOrder, error)
+}
+
+// orderSource is where the poll loop gets its orders from.
+var orderSource OrderSource = HTTPOrderSource{}
+
+// groupOrderSource is where the poll loop gets its orders from in group mode.
+var groupOrderSource GroupOrderSource = HTTPOrderSource{}
+
+// preferredEndpoint indexes the entry of apiEndpoints tried first: the last
+// one that answered.
+var preferredEndpoint atomic.Int32
+
+// checkOrderFailover checks addr against apiEndpoints in turn, starting with
+// the last one that answered, until one does.
+func checkOrderFailover(ctx context.Context, addr string) (AssignedOrder, error) {
+	var order AssignedOrder
+	err := failover(ctx, func(endpoint string) (err error) {
+		order, err = checkOrder(ctx, endpoint+"?prover="+addr)
+		return err
+	})
+	if err != nil {
+		return AssignedOrder{}, err
+	}
+	return order, nil
+}
+
+// checkProverOrder checks addr at the prover's own endpoint, if it has one,
+// or else at apiEndpoints with failover.
+func checkProverOrder(ctx context.Context, addr string) (AssignedOrder, error) {
+	endpoint := proverAPIEndpoints[addr]
+	if endpoint == "" {
+		return checkOrderFailover(ctx, addr)
+	}
+	var order AssignedOrder
+	err := withRetry(ctx, func() (err error) {
+		order, err = checkOrder(ctx, endpoint)
+		return err
+	})
+	if err != nil {
+		return AssignedOrder{}, err
+	}
+	return order, nil
+}
+
+// failover calls check, with retries, on each of apiEndpoints in turn,
+// starting with the last one that answered, until it succeeds on one.
+func failover(ctx context.Context, check func(endpoint string) error) error {
+	start := int(preferredEndpoint.Load())
+	var errs []error
+	for n := range apiEndpoints {
+		i := (start + n) % len(apiEndpoints)
+		err := withRetry(ctx, func() error { return check(apiEndpoints[i]) })
+		if err == nil {
+			if i != start && preferredEndpoint.CompareAndSwap(int32(start), int32(i)) {
+				slog.Warn("Order API failed over", "from", apiEndpoints[start], "to", apiEndpoints[i])
+			}
+			return nil
+		}
+		if len(apiEndpoints) == 1 || ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("Order API endpoint failed, trying the next one", "endpoint", apiEndpoints[i], "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", apiEndpoints[i], err))
+	}
+	return errors.Join(errs...)
+}
+
+// HTTPOrderSource queries the order API at apiEndpoints, using the batch
+// endpoint when one is configured and supported. Provers with their own
+// endpoint in proverAPIEndpoints are always checked there, one by one.
+type HTTPOrderSource struct{}
+
+func (HTTPOrderSource) Orders(ctx context.Context, addrs []string) (map[string]AssignedOrder, map[string]error) {
+	orders := make(map[string]AssignedOrder, len(addrs))
+	errs := make(map[string]error)
+
+	single := addrs
+	if apiBatchEndpoint != "" && !batchUnsupported {
+		var shared []string
+		single = nil
+		for _, addr := range addrs {
+			if proverAPIEndpoints[addr] == "" {
+				shared = append(shared, addr)
+			} else {
+				single = append(single, addr)
+			}
+		}
+
+		var batch map[string]AssignedOrder
+		var err error
+		if len(shared) > 0 {
+			err = withRetry(ctx, func() (err error) {
+				batch, err = checkOrders(ctx, shared)
+				return err
+			})
+		}
+		switch {
+		case errors.Is(err, errBatchUnsupported):
+			slog.Warn("Batch order endpoint returned 404, falling back to per-prover checks",
+				"endpoint", apiBatchEndpoint)
+			batchUnsupported = true
+			single = addrs
+		case err != nil:
+			for _, addr := range shared {
+				errs[addr] = err
+			}
+		default:
+			for _, addr := range shared {
+				orders[addr] = batch[addr]
+			}
+		}
+	}
+
+	// Check every prover at once so a poll takes one round trip, not one per
+	// prover, and the results describe the same moment.
+	results := make([]AssignedOrder, len(single))
+	resultErrs := make([]error, len(single))
+	var wg sync.WaitGroup
+	for i, addr := range single {
+		wg.Add(1)
+		go func(idx int, addr string) {
+			defer wg.Done()
+			results[idx], resultErrs[idx] = checkProverOrder(ctx, addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	for i, addr := range single {
+		if resultErrs[i] != nil {
+			errs[addr] = resultErrs[i]
+			continue
+		}
+		orders[addr] = results[i]
+	}
+	return orders, errs
+}
+
+func (HTTPOrderSource) HasOrder(ctx context.Context, addr string) (bool, error) {
+	order, err := checkProverOrder(ctx, addr)
+	return order.OrderExists, err
+}
+
+func (HTTPOrderSource) GroupOrders(ctx context.Context, group string) (map[string]AssignedOrder, error) {
+	var orders map[string]AssignedOrder
+	err := failover(ctx, func(endpoint string) (err error) {
+		orders, err = checkGroupOrders(ctx, endpoint, group)
+		return err
+	})
+	return orders, err
+}
+
+// pollOrders fetches the order status of every prover from orderSource, in
+// one call if it is a BatchOrderSource and otherwise with a HasOrder call per
+// prover, all at once.
+func pollOrders(ctx context.Context) (map[int]AssignedOrder, map[int]error) {
+	ids := proverIDs()
+	addrs := make([]string, len(ids))
+	for i, id := range ids {
+		addrs[i] = proverAddresses[id]
+	}
+
+	var byAddr map[string]AssignedOrder
+	var addrErrs map[string]error
+	if batch, ok := orderSource.(BatchOrderSource); ok {
+		byAddr, addrErrs = batch.Orders(ctx, addrs)
+	} else {
+		byAddr, addrErrs = hasOrders(ctx, orderSource, addrs)
+	}
+	orders := make(map[int]AssignedOrder, len(ids))
+	errs := make(map[int]error)
+	for _, id := range ids {
+		if err := addrErrs[proverAddresses[id]]; err != nil {
+			errs[id] = err
+			continue
+		}
+		orders[id] = byAddr[proverAddresses[id]]
+	}
+	return orders, errs
+}
+
+// hasOrders asks src about each of addrs at once, for a source that can only
+// be asked one prover at a time.
+func hasOrders(ctx context.Context, src OrderSource, addrs []string) (map[string]AssignedOrder, map[string]error) {
+	has := make([]bool, len(addrs))
+	hasErrs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(idx int, addr string) {
+			defer wg.Done()
+			has[idx], hasErrs[idx] = src.HasOrder(ctx, addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	orders := make(map[string]AssignedOrder, len(addrs))
+	errs := make(map[string]error)
+	for i, addr := range addrs {
+		if hasErrs[i] != nil {
+			errs[addr] = hasErrs[i]
+			continue
+		}
+		orders[addr] = AssignedOrder{OrderExists: has[i]}
+	}
+	return orders, errs
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withAPI loads testConfig against an order API served by handler, with the
+// extra top-level lines appended.
+func withAPI(t *testing.T, handler http.HandlerFunc, lines ...string) {
+	t.Helper()
+	api := httptest.NewServer(handler)
+	t.Cleanup(api.Close)
+	config := strings.Replace(testConfig(t.TempDir()), "http://127.0.0.1:1/is-assigned", api.URL+"/is-assigned", 1)
+	loadTestConfig(t, config+strings.Join(lines, "\n")+"\n")
+}
+
+func TestRunOnceRetriesBeforeFallback(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	withAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		prover := r.URL.Query().Get("prover")
+		mu.Lock()
+		calls[prover]++
+		n := calls[prover]
+		mu.Unlock()
+		switch {
+		case n <= 2:
+			http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		case strings.HasPrefix(prover, "0x1111"):
+			w.Write([]byte(`{"assigned":true}`))
+		default:
+			w.Write([]byte(`{"assigned":false}`))
+		}
+	}, "fallback_prover: 2", "fallback_policy: any_failed", "api_retries: 3")
+	srv := startSSHServer(t)
+
+	if err := runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	for prover, n := range calls {
+		if n != 3 {
+			t.Errorf("%s checked %d times, want 3", prover, n)
+		}
+	}
+	if currentActiveProver != 1 {
+		t.Errorf("active prover %d, want 1", currentActiveProver)
+	}
+	for _, ev := range history {
+		if ev.Reason == "fallback" {
+			t.Errorf("switched to the fallback prover: %+v", ev)
+		}
+	}
+	for _, c := range srv.lifecycle() {
+		if strings.HasSuffix(c.Command, "prover-2-aux-cluster\" && docker compose start") {
+			t.Errorf("%s got %q", c.Cluster, c.Command)
+		}
+	}
+}
+
+func TestRunOnceFallsBackWhenRetriesRunOut(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	withAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}, "fallback_prover: 2", "api_retries: 2")
+	startSSHServer(t)
+
+	if err := runOnce(context.Background()); err == nil {
+		t.Fatal("runOnce succeeded with the order API down")
+	}
+	if calls != 4 {
+		t.Errorf("API called %d times, want 2 per prover", calls)
+	}
+	if currentActiveProver != 2 {
+		t.Errorf("active prover %d, want the fallback 2", currentActiveProver)
+	}
+}
+
+func TestWithRetryZeroAttempts(t *testing.T) {
+	// loadConfig turns API_RETRIES=0 into the default, so only a zero global
+	// gets here, and then no check is made at all.
+	defer func(n int) { apiRetries = n }(apiRetries)
+	apiRetries = 0
+
+	called := false
+	err := withRetry(context.Background(), func() error {
+		called = true
+		return errors.New("unreachable")
+	})
+	if err != nil || called {
+		t.Errorf("got %v, called %v; want nil without calling fn", err, called)
+	}
+}
+
+// MockOrderSource reports the orders and errors it is given, by prover
+// address, and records the addresses it was asked about.
+type MockOrderSource struct {
+	mu     sync.Mutex
+	orders map[string]AssignedOrder
+	errs   map[string]error
+	calls  [][]string
+}
+
+// withMockOrders points orderSource at a MockOrderSource for the test.
+func withMockOrders(t *testing.T) *MockOrderSource {
+	t.Helper()
+	m := &MockOrderSource{}
+	orig := orderSource
+	orderSource = m
+	t.Cleanup(func() { orderSource = orig })
+	return m
+}
+
+// set makes the next polls report orders for the provers with
+// OrderExists true and errs for the provers in failed, by prover ID.
+func (m *MockOrderSource) set(orders map[int]AssignedOrder, failed ...int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.orders = map[string]AssignedOrder{}
+	for id, o := range orders {
+		m.orders[proverAddresses[id]] = o
+	}
+	m.errs = map[string]error{}
+	for _, id := range failed {
+		m.errs[proverAddresses[id]] = errors.New("order API unavailable")
+	}
+}
+
+func (m *MockOrderSource) HasOrder(ctx context.Context, addr string) (bool, error) {
+	orders, errs := m.Orders(ctx, []string{addr})
+	return orders[addr].OrderExists, errs[addr]
+}
+
+func (m *MockOrderSource) Orders(ctx context.Context, addrs []string) (map[string]AssignedOrder, map[string]error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, addrs)
+	orders := map[string]AssignedOrder{}
+	errs := map[string]error{}
+	for _, addr := range addrs {
+		if err := m.errs[addr]; err != nil {
+			errs[addr] = err
+			continue
+		}
+		orders[addr] = m.orders[addr]
+	}
+	return orders, errs
+}
+
+func TestRunOnceFollowsOrders(t *testing.T) {
+	withConfigLines(t, "fallback_prover: 1", "switch_debounce: 1")
+	startSSHServer(t)
+	m := withMockOrders(t)
+	assigned := AssignedOrder{OrderExists: true}
+
+	steps := []struct {
+		name     string
+		orders   map[int]AssignedOrder
+		failed   []int
+		wantErr  bool
+		clusters []int
+	}{
+		{name: "no orders", clusters: []int{0, 0}},
+		{name: "prover 2 busy", orders: map[int]AssignedOrder{2: assigned}, clusters: []int{2, 2}},
+		{name: "both busy", orders: map[int]AssignedOrder{1: assigned, 2: assigned}, clusters: []int{1, 2}},
+		{name: "one check failed", failed: []int{1}, wantErr: true, clusters: []int{1, 2}},
+		{name: "prover 1 busy", orders: map[int]AssignedOrder{1: {OrderExists: true, Count: 2}}, clusters: []int{1, 1}},
+		{name: "every check failed", failed: []int{1, 2}, wantErr: true, clusters: []int{1, 1}},
+		{name: "prover 2 busy again", orders: map[int]AssignedOrder{2: assigned}, clusters: []int{2, 2}},
+	}
+	for _, step := range steps {
+		m.set(step.orders, step.failed...)
+		lastSwitch = time.Time{}
+		err := runOnce(context.Background())
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: runOnce returned %v", step.name, err)
+		}
+		if !slices.Equal(clusterProvers, step.clusters) {
+			t.Errorf("%s: clusters run %v, want %v", step.name, clusterProvers, step.clusters)
+		}
+	}
+	if len(m.calls) != len(steps) {
+		t.Errorf("order source asked %d times, want once per poll", len(m.calls))
+	}
+	for _, addrs := range m.calls {
+		if !slices.Equal(addrs, []string{proverAddresses[1], proverAddresses[2]}) {
+			t.Errorf("asked about %v, want both provers in one call", addrs)
+		}
+	}
+}
+
+// singleOrderSource hides the Orders method of its MockOrderSource, so it
+// can only be asked one prover at a time.
+type singleOrderSource struct{ m *MockOrderSource }
+
+func (s singleOrderSource) HasOrder(ctx context.Context, addr string) (bool, error) {
+	return s.m.HasOrder(ctx, addr)
+}
+
+func TestPollOrdersOneAtATime(t *testing.T) {
+	withConfigLines(t)
+	m := withMockOrders(t)
+	orderSource = singleOrderSource{m}
+	m.set(map[int]AssignedOrder{2: {OrderExists: true, Count: 5}}, 1)
+
+	orders, errs := pollOrders(context.Background())
+	if errs[1] == nil || len(errs) != 1 {
+		t.Errorf("errors %v, want one for prover 1", errs)
+	}
+	if want := (AssignedOrder{OrderExists: true}); orders[2] != want {
+		t.Errorf("prover 2: got %+v, want %+v", orders[2], want)
+	}
+	if len(m.calls) != 2 {
+		t.Errorf("asked %v, want each prover on its own", m.calls)
+	}
+}
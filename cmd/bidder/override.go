@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type overrideRequest struct {
+	Prover     int `json:"prover"`
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+type overrideStatus struct {
+	Prover    int       `json:"prover"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// activeOverride returns the pinned prover and how long the pin has left, or
+// zero if there is none. An expired override is cleared here.
+func activeOverride() (int, time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if overrideProver == 0 {
+		return 0, 0
+	}
+	remaining := time.Until(overrideUntil)
+	if remaining <= 0 {
+		slog.Info("Override expired, resuming automatic switching", "prover", overrideProver)
+		overrideProver, overrideUntil = 0, time.Time{}
+		return 0, 0
+	}
+	return overrideProver, remaining
+}
+
+// handleOverride switches every cluster to the requested prover, ignoring the
+// cooldown, and pins it there for the TTL.
+func handleOverride(w http.ResponseWriter, r *http.Request) {
+	var req overrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := proverFolders[req.Prover]; !ok {
+		http.Error(w, fmt.Sprintf("unknown prover %d", req.Prover), http.StatusBadRequest)
+		return
+	}
+	if req.TTLSeconds <= 0 {
+		http.Error(w, "ttl_seconds must be positive", http.StatusBadRequest)
+		return
+	}
+
+	// An operator override supersedes any automatic switch still running,
+	// unless that one is already heading for the same prover, in which case
+	// it is left to finish first. The switch must finish even if the client
+	// disconnects.
+	ctx, done, ok := beginSwitch(context.WithoutCancel(r.Context()), fmt.Sprintf("prover %d", req.Prover))
+	for !ok {
+		awaitSwitch()
+		ctx, done, ok = beginSwitch(context.WithoutCancel(r.Context()), fmt.Sprintf("prover %d", req.Prover))
+	}
+	defer done()
+
+	slog.Warn("Override requested", "prover", req.Prover, "ttl_seconds", req.TTLSeconds, "remote", r.RemoteAddr)
+	err := switchTo(ctx, req.Prover, "override")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if currentActiveProver != req.Prover {
+		http.Error(w, fmt.Sprintf("switch to prover %d failed: %v", req.Prover, err), http.StatusBadGateway)
+		return
+	}
+	overrideProver = req.Prover
+	overrideUntil = time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overrideStatus{Prover: overrideProver, ExpiresAt: overrideUntil})
+}
+
+// handleClearOverride lifts the override so the next poll decides normally.
+func handleClearOverride(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if overrideProver != 0 {
+		slog.Info("Override cleared", "prover", overrideProver, "remote", r.RemoteAddr)
+	}
+	overrideProver, overrideUntil = 0, time.Time{}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// clusterPlan is what a switch would do on one cluster.
+type clusterPlan struct {
+	Cluster string `json:"cluster"`
+	Current int    `json:"current"` // 0 if unknown, when the switch checks it first
+	Target  int    `json:"target"`
+	// Skip says why the switch would leave the cluster alone.
+	Skip     string   `json:"skip,omitempty"`
+	DrainURL string   `json:"drain_url,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+}
+
+type switchPlan struct {
+	From              string        `json:"from"`
+	To                string        `json:"to"`
+	CooldownRemaining int64         `json:"cooldown_remaining_seconds,omitempty"`
+	Clusters          []clusterPlan `json:"clusters"`
+}
+
+// handlePlan returns, without running anything, the compose commands a switch
+// would issue on each cluster: to one prover for ?prover=2, or for a split
+// across several for ?prover=1,2, weighted by splitRatio or else by the
+// optional ?weights=3,1 the way splitProvers weighs order counts.
+func handlePlan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ids, err := parseIDs(q.Get("prover"))
+	if err != nil || len(ids) == 0 {
+		http.Error(w, "prover must be one prover ID or a comma-separated list", http.StatusBadRequest)
+		return
+	}
+	for k, id := range ids {
+		if _, ok := proverFolders[id]; !ok {
+			http.Error(w, fmt.Sprintf("unknown prover %d", id), http.StatusBadRequest)
+			return
+		}
+		if slices.Contains(ids[:k], id) {
+			http.Error(w, fmt.Sprintf("prover %d listed twice", id), http.StatusBadRequest)
+			return
+		}
+	}
+	weights := make([]int, len(ids))
+	for k := range weights {
+		weights[k] = 1
+	}
+	if s := q.Get("weights"); s != "" {
+		weights, err = parseIDs(s)
+		if err != nil || len(weights) != len(ids) || slices.Contains(weights, 0) {
+			http.Error(w, fmt.Sprintf("weights must be %d positive numbers, one per prover", len(ids)), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	from := currentState()
+	to := State{Prover: ids[0]}
+	assignment := make([]int, len(clusters))
+	switch {
+	case len(ids) > 1:
+		to = State{Split: ids}
+		if len(splitRatio) > 0 {
+			for k, id := range ids {
+				weights[k] = splitRatio[id-1]
+			}
+		}
+		// splitProvers does nothing when the split is already in place.
+		if !splitMode || !slices.Equal(splitActive, ids) {
+			assignment = splitAssignment(ids, weights)
+		}
+	case ids[0] != currentActiveProver:
+		for i := range assignment {
+			assignment[i] = ids[0]
+		}
+	}
+
+	plan := switchPlan{From: from.String(), To: to.String(), Clusters: make([]clusterPlan, len(clusters))}
+	if remaining := cooldownRemaining(); remaining > 0 {
+		plan.CooldownRemaining = int64(remaining.Round(time.Second).Seconds())
+	}
+	for i, c := range clusters {
+		cp := clusterPlan{Cluster: clusterKey(c), Current: clusterProvers[i], Target: assignment[i]}
+		switch {
+		case assignment[i] == 0:
+			cp.Skip = "already in this state"
+		case quarantined[clusterKey(c)]:
+			cp.Skip = "quarantined"
+		case assignment[i] == clusterProvers[i]:
+			cp.Skip = "already running"
+		default:
+			if !warmStandby {
+				cp.DrainURL = c.DrainURL
+			}
+			cp.Commands = activationCommands(c, assignment[i])
+		}
+		plan.Clusters[i] = cp
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// activationCommands lists the compose commands activateOnCluster issues to
+// make target the only prover on the cluster, in order, leaving out the
+// checks and retries that don't change what runs.
+func activationCommands(cluster Cluster, target int) []string {
+	start, stop := "start", "stop"
+	if warmStandby {
+		start, stop = warmServeAction, warmIdleAction
+	}
+	var stops []string
+	for _, id := range proverIDs() {
+		if id != target {
+			stops = append(stops, buildCommand(cluster, id, stop))
+		}
+	}
+	cmds := []string{buildCommand(cluster, target, start)}
+	if switchOrder == switchStopFirst {
+		return append(stops, cmds...)
+	}
+	return append(cmds, stops...)
+}
+
+// parseIDs parses a comma-separated list of positive integers.
+func parseIDs(s string) ([]int, error) {
+	var ids []int
+	for _, part := range splitList(s) {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid number %q", part)
+		}
+		ids = append(ids, n)
+	}
+	return ids, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	servingPollInterval   = 5 * time.Second
+	servingRequestTimeout = 10 * time.Second
+	maxProbeBody          = 4096
+)
+
+var probeClient = &http.Client{Timeout: servingRequestTimeout}
+
+// probeServing waits for each of ids to report ready at servingProbeURL, at
+// most servingProbeTimeout after the switch brought it up, and returns the
+// provers that never did. Each one's time to ready is logged and observed.
+func probeServing(ctx context.Context, ids []int) ([]int, error) {
+	if servingProbeURL == "" || dryRun {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, servingProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(idx, id int) {
+			defer wg.Done()
+			errs[idx] = waitServing(ctx, id, start)
+		}(i, id)
+	}
+	wg.Wait()
+
+	var failed []int
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, ids[i])
+			servingProbeFailuresTotal.Inc()
+			slog.Error("Prover not serving after switch", "prover", ids[i], "error", err)
+		}
+	}
+	return failed, errors.Join(errs...)
+}
+
+// waitServing polls the probe URL of prover id until it reports ready or ctx
+// is done.
+func waitServing(ctx context.Context, id int, start time.Time) error {
+	target := strings.NewReplacer(
+		"{prover}", strconv.Itoa(id),
+		"{address}", url.QueryEscape(proverAddresses[id]),
+	).Replace(servingProbeURL)
+
+	for {
+		err := probeReady(ctx, target)
+		if err == nil {
+			elapsed := time.Since(start)
+			servingProbeDuration.WithLabelValues(strconv.Itoa(id)).Observe(elapsed.Seconds())
+			slog.Info("Prover serving", "prover", id, "time_to_ready_ms", elapsed.Milliseconds())
+			return nil
+		}
+		slog.Debug("Prover not serving yet", "prover", id, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("prover %d not ready after %s: %w", id, servingProbeTimeout, err)
+		case <-time.After(servingPollInterval):
+		}
+	}
+}
+
+// probeReady GETs target once. It is ready on a 2xx response, unless the body
+// is a JSON object whose "ready" field is false. The order API's token and
+// headers are sent only when target is on an order API host, shared or per
+// prover.
+func probeReady(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	endpoints := append(slices.Clone(apiEndpoints), slices.Collect(maps.Values(proverAPIEndpoints))...)
+	if slices.ContainsFunc(endpoints, func(e string) bool {
+		u, err := url.Parse(e)
+		return err == nil && u.Host == req.URL.Host
+	}) {
+		setAPIHeaders(req)
+	}
+
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("probe returned %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	var status struct {
+		Ready *bool `json:"ready"`
+	}
+	if json.Unmarshal(body, &status) == nil && status.Ready != nil && !*status.Ready {
+		return errors.New("probe reported not ready")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+type quarantineStatus struct {
+	IP          string `json:"ip"`
+	Port        int    `json:"port"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+// handleQuarantine takes clusters out of rotation for maintenance: the one
+// cluster for "ip:port", or every cluster on the host for a bare "ip".
+// Switches leave them running whatever they run now until they are released.
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	entry := r.PathValue("ip")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	idx := matchClusters(clusters, entry)
+	if len(idx) == 0 {
+		http.Error(w, fmt.Sprintf("unknown cluster %s", entry), http.StatusNotFound)
+		return
+	}
+	for _, i := range idx {
+		if key := clusterKey(clusters[i]); !quarantined[key] {
+			quarantined[key] = true
+			slog.Warn("Cluster quarantined, switches will skip it", "cluster", key, "remote", r.RemoteAddr)
+		}
+	}
+	writeQuarantine(w, clusters, idx, true)
+}
+
+// handleRelease returns quarantined clusters, named as for handleQuarantine,
+// to rotation. Their state is unknown after maintenance, so they are checked
+// and switched to the prover they should be running straight away, once any
+// switch in progress has finished and within switchDeadline like any other.
+func handleRelease(w http.ResponseWriter, r *http.Request) {
+	entry := r.PathValue("ip")
+
+	mu.Lock()
+	known := len(matchClusters(clusters, entry)) > 0
+	mu.Unlock()
+	if !known {
+		http.Error(w, fmt.Sprintf("unknown cluster %s", entry), http.StatusNotFound)
+		return
+	}
+
+	// The realignment must finish even if the client disconnects.
+	awaitSwitch()
+	ctx, done, _ := beginSwitch(context.WithoutCancel(r.Context()), "release "+entry)
+	defer done()
+
+	mu.Lock()
+	idx := matchClusters(clusters, entry)
+	assignment := make([]int, len(clusters))
+	for _, i := range idx {
+		key := clusterKey(clusters[i])
+		if !quarantined[key] {
+			continue
+		}
+		delete(quarantined, key)
+		slog.Info("Cluster released from quarantine", "cluster", key, "remote", r.RemoteAddr)
+
+		clusterProvers[i] = 0
+		target := currentActiveProver
+		if splitMode && len(splitActive) > 0 {
+			target = slices.MinFunc(splitActive, func(a, b int) int {
+				group := clusters[i].Group
+				return proverWeight(clusters, clusterProvers, assignment, group, a) -
+					proverWeight(clusters, clusterProvers, assignment, group, b)
+			})
+		}
+		assignment[i] = target
+	}
+	cs := slices.Clone(clusters)
+	b := newSwitchBatch(assignment)
+	mu.Unlock()
+
+	if slices.ContainsFunc(assignment, func(id int) bool { return id != 0 }) {
+		_, err := applyWithDeadline(ctx, b)
+		mu.Lock()
+		saveState()
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("released, but %v", err), http.StatusBadGateway)
+			return
+		}
+	}
+	writeQuarantine(w, cs, idx, false)
+}
+
+// writeQuarantine reports the quarantine state of cs[i] for each i in idx.
+func writeQuarantine(w http.ResponseWriter, cs []Cluster, idx []int, held bool) {
+	resp := make([]quarantineStatus, len(idx))
+	for j, i := range idx {
+		resp[j] = quarantineStatus{IP: cs[i].IP, Port: cs[i].Port, Quarantined: held}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
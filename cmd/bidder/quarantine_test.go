@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestQuarantineByClusterKey(t *testing.T) {
+	// Two clusters on one host, told apart by port.
+	loadTestConfig(t, strings.Replace(testConfig(t.TempDir()), "  - ip: 10.0.0.2\n", "  - ip: 10.0.0.1\n    port: 2222\n", 1))
+	srv := startSSHServer(t)
+	const other = "10.0.0.1:2222"
+
+	quarantine := func(h http.HandlerFunc, method, entry string) int {
+		t.Helper()
+		r := httptest.NewRequest(method, "/clusters/x/quarantine", nil)
+		r.SetPathValue("ip", entry)
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		return rec.Code
+	}
+	held := func() []string {
+		var keys []string
+		for key := range quarantined {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+
+	if code := quarantine(handleQuarantine, http.MethodPut, "[10.0.0.1]:2222"); code != http.StatusOK {
+		t.Fatalf("quarantine returned %d", code)
+	}
+	if got := held(); !slices.Equal(got, []string{other}) {
+		t.Errorf("quarantined %v, want only %s", got, other)
+	}
+	if err := switchProver(context.Background(), 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.lifecycleOn(other); len(got) != 0 {
+		t.Errorf("quarantined cluster got %q", got)
+	}
+
+	if code := quarantine(handleRelease, http.MethodDelete, other); code != http.StatusOK {
+		t.Fatalf("release returned %d", code)
+	}
+	if len(quarantined) != 0 || !slices.Equal(clusterProvers, []int{1, 1}) {
+		t.Errorf("quarantined %v, clusters %v; want released and switched to 1", held(), clusterProvers)
+	}
+
+	// A bare IP names every cluster on the host.
+	quarantine(handleQuarantine, http.MethodPut, "10.0.0.1")
+	if got := held(); !slices.Equal(got, []string{cluster1, other}) {
+		t.Errorf("quarantined %v, want both clusters", got)
+	}
+	quarantine(handleRelease, http.MethodDelete, "10.0.0.1")
+	if len(quarantined) != 0 {
+		t.Errorf("still quarantined: %v", held())
+	}
+	if code := quarantine(handleRelease, http.MethodDelete, "10.0.0.9"); code != http.StatusNotFound {
+		t.Errorf("unknown cluster returned %d", code)
+	}
+}
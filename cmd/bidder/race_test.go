@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestConcurrentAccess runs what the bidder does at once in production: the
+// poll loop polling and reloading, the status server answering queries,
+// overrides and quarantines, and the watchdog and reconciler, all switching
+// clusters over SSH so their switches overlap. Run it with -race.
+func TestConcurrentAccess(t *testing.T) {
+	path := withConfigLines(t, "switch_debounce: 1")
+	srv := startSSHServer(t)
+	m := withMockOrders(t)
+	assigned := AssignedOrder{OrderExists: true}
+
+	// Fail some starts and crash some provers, so that reconcile and the
+	// watchdog have clusters to fix.
+	var starts atomic.Int32
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if strings.HasSuffix(cmd, " start") && starts.Add(1)%4 == 0 {
+			return "Error response from daemon: no such container\n", 1, true
+		}
+		return "", 0, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const rounds = 30
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				f(i)
+			}
+		}()
+	}
+	request := func(h http.HandlerFunc, method, target, body string) {
+		h(httptest.NewRecorder(), httptest.NewRequest(method, target, strings.NewReader(body)))
+	}
+
+	// The poll loop, where reloads also run.
+	run(func(i int) {
+		switch i % 3 {
+		case 0:
+			m.set(map[int]AssignedOrder{1: assigned})
+		case 1:
+			m.set(map[int]AssignedOrder{1: assigned, 2: assigned})
+		case 2:
+			m.set(nil, 1, 2)
+		}
+		runOnce(ctx)
+		if i%5 == 0 {
+			reloadConfig(ctx, path)
+		}
+	})
+	run(func(int) {
+		request(handleStatus, http.MethodGet, "/status", "")
+		request(handleOrders, http.MethodGet, "/orders", "")
+		request(handleHistory, http.MethodGet, "/history", "")
+		request(handleHealthz, http.MethodGet, "/healthz", "")
+		request(handleReadyz, http.MethodGet, "/readyz", "")
+	})
+	run(func(int) {
+		request(handlePlan, http.MethodGet, "/plan?prover=2", "")
+		request(handlePlan, http.MethodGet, "/plan?prover=1,2&weights=3,1", "")
+	})
+	run(func(i int) {
+		if i%2 == 0 {
+			request(handleOverride, http.MethodPost, "/override", `{"prover":2,"ttl_seconds":60}`)
+		} else {
+			request(handleClearOverride, http.MethodDelete, "/override", "")
+		}
+	})
+	run(func(i int) {
+		r := httptest.NewRequest(http.MethodPut, "/clusters/x/quarantine", nil)
+		r.SetPathValue("ip", cluster2)
+		if i%2 == 0 {
+			handleQuarantine(httptest.NewRecorder(), r)
+		} else {
+			handleRelease(httptest.NewRecorder(), r)
+		}
+	})
+	run(func(i int) {
+		switchProver(ctx, 1+i%2, "test")
+		srv.crash(cluster1, prover1)
+		checkProvers(ctx)
+		reconcile(ctx)
+	})
+	wg.Wait()
+	if len(srv.lifecycle()) == 0 {
+		t.Error("no cluster was switched")
+	}
+}
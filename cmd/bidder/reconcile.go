@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// reconcileLoop runs reconcile every reconcileInterval until ctx is done.
+func reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reconcile(ctx)
+		}
+	}
+}
+
+// reconcile retries the clusters in outOfSync, those whose last switch
+// failed, so one bad attempt doesn't leave a cluster down until the next
+// switch of the whole fleet. Clusters that make it leave the set. The retries
+// run without mu, against a snapshot of the clusters, so a slow or unreachable
+// cluster doesn't hold up status queries; mu is taken again only to record the
+// results of clusters nothing else has changed since. Reconciling yields to
+// switches: it doesn't start while one is in progress, and one starting
+// cancels it and waits for it to return.
+func reconcile(ctx context.Context) {
+	mu.Lock()
+	present := make(map[string]bool, len(clusters))
+	cs := slices.Clone(clusters)
+	known := slices.Clone(clusterProvers)
+	assignment := make([]int, len(cs))
+	var keys []string
+	for i, c := range cs {
+		key := clusterKey(c)
+		present[key] = true
+		if target := outOfSync[key]; target != 0 && !quarantined[key] {
+			assignment[i] = target
+			keys = append(keys, key)
+		}
+	}
+	// Clusters removed by a reload no longer need reconciling.
+	for key := range outOfSync {
+		if !present[key] {
+			delete(outOfSync, key)
+		}
+	}
+	mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	ctx, done, started := beginReconcile(ctx)
+	if !started {
+		slog.Debug("Switch in progress, reconciling later", "clusters", keys)
+		return
+	}
+	defer done()
+
+	slog.Info("Reconciling out-of-sync clusters", "clusters", keys)
+	errs := switchClusters(ctx, cs, known, assignment)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Map the results onto the clusters as they are now, leaving out any a
+	// reload, quarantine or switch has changed since the snapshot.
+	now := make([]int, len(clusters))
+	skip := make([]bool, len(clusters))
+	nowErrs := make([]error, len(clusters))
+	var stale []string
+	for i, c := range clusters {
+		key := clusterKey(c)
+		j := slices.IndexFunc(cs, func(s Cluster) bool { return clusterKey(s) == key })
+		switch {
+		case j < 0 || assignment[j] == 0:
+			skip[i] = true
+		case clusterProvers[i] != known[j] || outOfSync[key] != assignment[j] || quarantined[key]:
+			skip[i] = true
+			stale = append(stale, key)
+		default:
+			now[i], nowErrs[i] = assignment[j], errs[j]
+		}
+	}
+	if len(stale) > 0 {
+		slog.Info("Clusters changed while reconciling, leaving them as they are", "clusters", stale)
+	}
+	ok, err := recordAssignment(now, skip, nowErrs)
+	saveState()
+	if err != nil {
+		slog.Warn("Some clusters still out of sync", "fixed", ok, "total", len(keys), "error", err)
+		return
+	}
+	slog.Info("Clusters back in sync", "clusters", keys)
+}
+
+// beginReconcile returns the context for a reconcile, unless a switch is in
+// progress, in which case ok is false. A switch that starts before done is
+// called cancels ctx and waits for done.
+func beginReconcile(parent context.Context) (ctx context.Context, done func(), ok bool) {
+	switchMu.Lock()
+	defer switchMu.Unlock()
+
+	if inFlight != nil || reconcileDone != nil {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(parent)
+	finished := make(chan struct{})
+	reconcileCancel, reconcileDone = cancel, finished
+	return ctx, func() {
+		cancel()
+		switchMu.Lock()
+		reconcileCancel, reconcileDone = nil, nil
+		switchMu.Unlock()
+		close(finished)
+	}, true
+}
+
+// dropOutOfSync forgets the clusters the batch targeted, for a switch that
+// failed everywhere: the state it aimed for was never adopted, so there is
+// nothing to reconcile them to. Callers must hold mu.
+func dropOutOfSync(b switchBatch) {
+	for i, c := range b.clusters {
+		if b.assignment[i] != 0 {
+			delete(outOfSync, clusterKey(c))
+		}
+	}
+}
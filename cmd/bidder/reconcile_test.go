@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failStartOn2 leaves cluster2 out of sync: the switch to prover 2 fails to
+// start it there and keeps prover 1 running.
+func failStartOn2(t *testing.T, srv *testSSHServer) {
+	t.Helper()
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if cluster == cluster2 && strings.HasSuffix(cmd, "prover-2-aux-cluster\" && docker compose start") {
+			return "no such container\n", 1, true
+		}
+		return "", 0, false
+	}
+	if err := switchProver(context.Background(), 2, "test"); err == nil {
+		t.Fatal("switch succeeded on both clusters")
+	}
+	if outOfSync[cluster2] != 2 {
+		t.Fatalf("out of sync %v, want %s to prover 2", outOfSync, cluster2)
+	}
+	srv.script = nil
+	srv.reset()
+}
+
+func TestReconcileRetriesOutOfSync(t *testing.T) {
+	withConfigLines(t, "switch_order: start_first")
+	srv := startSSHServer(t)
+	failStartOn2(t, srv)
+
+	reconcile(context.Background())
+	if !slices.Equal(clusterProvers, []int{2, 2}) || len(outOfSync) != 0 {
+		t.Errorf("clusters %v, out of sync %v; want 2 everywhere", clusterProvers, outOfSync)
+	}
+	if got := srv.lifecycleOn(cluster1); len(got) != 0 {
+		t.Errorf("%s got %q, want it left alone", cluster1, got)
+	}
+}
+
+func TestReconcileWithoutLock(t *testing.T) {
+	withConfigLines(t, "switch_order: start_first")
+	srv := startSSHServer(t)
+	failStartOn2(t, srv)
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if strings.HasSuffix(cmd, " start") {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+		}
+		return "", 0, false
+	}
+	done := make(chan struct{})
+	go func() {
+		reconcile(context.Background())
+		close(done)
+	}()
+
+	<-blocked
+	if !mu.TryLock() {
+		close(release)
+		t.Fatal("reconcile holds mu while switching")
+	}
+	mu.Unlock()
+	close(release)
+	<-done
+	if !slices.Equal(clusterProvers, []int{2, 2}) || len(outOfSync) != 0 {
+		t.Errorf("clusters %v, out of sync %v; want 2 everywhere", clusterProvers, outOfSync)
+	}
+}
+
+func TestSwitchWaitsForReconcile(t *testing.T) {
+	withConfigLines(t, "switch_order: start_first")
+	srv := startSSHServer(t)
+	failStartOn2(t, srv)
+	lastSwitch = time.Time{}
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if strings.HasSuffix(cmd, " start") {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+		}
+		return "", 0, false
+	}
+	reconciled := make(chan struct{})
+	go func() {
+		reconcile(context.Background())
+		close(reconciled)
+	}()
+	<-blocked
+
+	switched := make(chan error, 1)
+	go func() { switched <- switchProver(context.Background(), 1, "test") }()
+	select {
+	case err := <-switched:
+		t.Fatalf("switch returned %v before the reconcile finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-reconciled
+	if err := <-switched; err != nil {
+		t.Fatalf("switch: %v", err)
+	}
+
+	if !slices.Equal(clusterProvers, []int{1, 1}) || len(outOfSync) != 0 || currentActiveProver != 1 {
+		t.Errorf("active %d, clusters %v, out of sync %v; want 1 everywhere",
+			currentActiveProver, clusterProvers, outOfSync)
+	}
+	if got := srv.lifecycleOn(cluster2); len(got) == 0 || got[len(got)-1] != prover2+" stop" {
+		t.Errorf("%s got %q, want the switch to stop prover 2 last", cluster2, got)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// reloadConfig re-runs the config loader and swaps in the new cluster list,
+// API endpoints and prover addresses. Added clusters are switched to the
+// current prover; removed clusters are no longer managed but keep running
+// whatever they run now. The reload waits for a switch in progress and holds
+// off others until the added clusters are switched. An invalid config is
+// rejected and the old one kept.
+// Other settings, including the provers' folders, compose files and
+// projects, only change on restart.
+func reloadConfig(ctx context.Context, configPath string) {
+	slog.Info("Reloading config", "path", configPath)
+
+	cfg, err := loadConfig(configPath)
+	if err == nil && len(cfg.Provers) != len(proverFolders) {
+		err = fmt.Errorf("prover count changed from %d to %d, restart to add or remove provers",
+			len(proverFolders), len(cfg.Provers))
+	}
+	if err != nil {
+		slog.Error("Config reload rejected, keeping current config", "error", err)
+		return
+	}
+
+	// Let a switch in progress finish, so it doesn't commit a prover over the
+	// one the added clusters are given, and cancel any reconcile.
+	awaitSwitch()
+	ctx, done, _ := beginSwitch(ctx, "reload")
+	defer done()
+
+	mu.Lock()
+	prev := make(map[string]int, len(clusters))
+	for i, c := range clusters {
+		prev[clusterKey(c)] = i
+	}
+
+	newProvers := make([]int, len(cfg.Clusters))
+	var added, stale []string
+	kept := make(map[string]bool, len(cfg.Clusters))
+	for i, c := range cfg.Clusters {
+		key := clusterKey(c)
+		if j, ok := prev[key]; ok {
+			newProvers[i] = clusterProvers[j]
+			kept[key] = true
+			if old := clusters[j]; c.User != old.User || c.Password != old.Password || c.KeyPath != old.KeyPath {
+				stale = append(stale, key)
+			}
+			continue
+		}
+		added = append(added, key)
+	}
+
+	var removed []string
+	for _, c := range clusters {
+		if key := clusterKey(c); !kept[key] {
+			removed = append(removed, key)
+		}
+	}
+
+	// Added clusters join the active prover, or in split mode whichever split
+	// prover has the least cluster weight in their group.
+	assignment := make([]int, len(cfg.Clusters))
+	for i, c := range cfg.Clusters {
+		if _, ok := prev[clusterKey(c)]; ok {
+			continue
+		}
+		target := currentActiveProver
+		if splitMode && len(splitActive) > 0 {
+			target = slices.MinFunc(splitActive, func(a, b int) int {
+				return proverWeight(cfg.Clusters, newProvers, assignment, c.Group, a) -
+					proverWeight(cfg.Clusters, newProvers, assignment, c.Group, b)
+			})
+		}
+		assignment[i] = target
+	}
+
+	var changes []any
+	if len(added) > 0 {
+		changes = append(changes, "clusters_added", added)
+	}
+	if len(removed) > 0 {
+		changes = append(changes, "clusters_removed", removed)
+	}
+	endpoints := cfg.apiEndpoints()
+	if !slices.Equal(endpoints, apiEndpoints) {
+		changes = append(changes, "api_endpoint", fmt.Sprintf("%s → %s",
+			strings.Join(apiEndpoints, ","), strings.Join(endpoints, ",")))
+	}
+	if cfg.APIBatchEndpoint != apiBatchEndpoint {
+		changes = append(changes, "api_batch_endpoint", fmt.Sprintf("%s → %s", apiBatchEndpoint, cfg.APIBatchEndpoint))
+	}
+	var addrChanges []string
+	for i, p := range cfg.Provers {
+		if id := i + 1; p.Address != proverAddresses[id] {
+			addrChanges = append(addrChanges, fmt.Sprintf("%d: %s → %s", id, proverAddresses[id], p.Address))
+		}
+	}
+	if len(addrChanges) > 0 {
+		changes = append(changes, "prover_addresses", addrChanges)
+	}
+	var endpointChanges []string
+	for i, p := range cfg.Provers {
+		if old := proverAPIEndpoints[proverAddresses[i+1]]; p.APIEndpoint != old {
+			endpointChanges = append(endpointChanges, fmt.Sprintf("%d: %q → %q", i+1, old, p.APIEndpoint))
+		}
+	}
+	if len(endpointChanges) > 0 {
+		changes = append(changes, "prover_api_endpoints", endpointChanges)
+	}
+	// Every switch and health check reads the provers' own folders, compose
+	// files and projects without mu, so those only change on restart.
+	var layoutChanges []string
+	for i, p := range cfg.Provers {
+		id := i + 1
+		for _, f := range []struct{ name, old, new string }{
+			{"folder", proverFolders[id], p.Folder},
+			{"compose_file", proverComposeFiles[id], p.ComposeFile},
+			{"project", proverProjects[id], p.Project},
+		} {
+			if f.new != f.old {
+				layoutChanges = append(layoutChanges, fmt.Sprintf("%d %s: %q → %q", id, f.name, f.old, f.new))
+			}
+		}
+	}
+	if len(layoutChanges) > 0 {
+		slog.Warn("Prover folder, compose file and project changes need a restart, keeping the current ones",
+			"changes", layoutChanges)
+	}
+	clusters = cfg.Clusters
+	clusterProvers = newProvers
+	if !slices.Equal(endpoints, apiEndpoints) {
+		apiEndpoints = endpoints
+		preferredEndpoint.Store(0)
+	}
+	if cfg.APIBatchEndpoint != apiBatchEndpoint {
+		apiBatchEndpoint = cfg.APIBatchEndpoint
+		batchUnsupported = false
+	}
+	for i, p := range cfg.Provers {
+		proverAddresses[i+1] = p.Address
+	}
+	setProverEndpoints(cfg)
+	// Quarantine is set at runtime, so only added clusters take theirs from
+	// the config.
+	for _, key := range removed {
+		delete(quarantined, key)
+	}
+	for _, key := range cfg.quarantinedKeys() {
+		if slices.Contains(added, key) {
+			quarantined[key] = true
+		}
+	}
+	// Credential changes and the clusters' own folders, compose files and
+	// compose commands aren't listed but take effect with the new clusters.
+	slog.Info("Config reloaded", changes...)
+
+	// Connections to removed clusters, or made with credentials that just
+	// changed, are closed once the commands running over them are done.
+	retireClients(append(stale, removed...))
+	b := newSwitchBatch(assignment)
+	saveState()
+	mu.Unlock()
+
+	if slices.ContainsFunc(assignment, func(id int) bool { return id != 0 }) {
+		slog.Info("Switching added clusters", "clusters", added)
+		applyWithDeadline(ctx, b)
+
+		mu.Lock()
+		saveState()
+		mu.Unlock()
+	}
+}
+
+// proverWeight totals the weight of the clusters in group running, or about to
+// run, prover id.
+func proverWeight(cs []Cluster, current, assignment []int, group string, id int) int {
+	n := 0
+	for i := range current {
+		if cs[i].Group == group && (current[i] == id || assignment[i] == id) {
+			n += cs[i].Weight
+		}
+	}
+	return n
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReloadKeepsProverLayout(t *testing.T) {
+	path := withConfigLines(t)
+	srv := startSSHServer(t)
+	config, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move prover 1 and give cluster 2 its own folder for prover 2.
+	changed := strings.Replace(string(config), `  - address: "0x1111111111111111111111111111111111111111"`,
+		`  - address: "0x1111111111111111111111111111111111111111"
+    folder: ~/moved
+    project: moved`, 1)
+	changed = strings.Replace(changed, "    password: pass2\n", "    password: pass2\n    folders:\n      2: /srv/p2\n", 1)
+	if err := os.WriteFile(path, []byte(changed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(context.Background(), path)
+
+	if proverFolders[1] != "~/prover-1-aux-cluster" || proverProjects[1] != "" {
+		t.Errorf("prover 1 folder %q, project %q changed without a restart", proverFolders[1], proverProjects[1])
+	}
+	if err := switchProver(context.Background(), 2, "test"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`cd "$HOME/prover-1-aux-cluster" && docker compose stop`,
+		`cd "/srv/p2" && docker compose start`,
+	}
+	if got := srv.lifecycleOn(cluster2); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReloadRetiresChangedCredentials(t *testing.T) {
+	path := withConfigLines(t)
+	srv := startSSHServer(t)
+	if err := switchProver(context.Background(), 2, "test"); err != nil {
+		t.Fatal(err)
+	}
+	kept, changed := pool[cluster1], pool[cluster2]
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if strings.HasSuffix(cmd, " ps --services") {
+			close(blocked)
+			<-release
+		}
+		return "", 0, false
+	}
+	running := make(chan error)
+	go func() {
+		_, err := dockerCompose(context.Background(), clusters[1], 2, "ps --services")
+		running <- err
+	}()
+	<-blocked
+
+	config, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Replace(string(config), "password: pass2", "password: rotated", 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(context.Background(), path)
+
+	poolMu.Lock()
+	if pool[cluster1] != kept || pool[cluster2] != nil || !retired[changed] {
+		t.Errorf("pool %v, retired %v; want cluster 1 kept and cluster 2 retired", pool, retired)
+	}
+	poolMu.Unlock()
+	close(release)
+	if err := <-running; err != nil {
+		t.Errorf("command running during the reload failed: %v", err)
+	}
+	if _, err := changed.NewSession(); err == nil {
+		t.Error("retired connection still open after its last command")
+	}
+}
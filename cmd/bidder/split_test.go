@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// setClusters replaces the loaded clusters with one of weight 1 per group
+// name given, for the duration of the test.
+func setClusters(t *testing.T, groups ...string) {
+	t.Helper()
+	orig := clusters
+	clusters = make([]Cluster, len(groups))
+	for i, g := range groups {
+		clusters[i] = Cluster{IP: fmt.Sprintf("10.0.0.%d", i+1), Port: 22, Group: g, Weight: 1}
+	}
+	t.Cleanup(func() { clusters = orig })
+}
+
+func TestSplitAssignmentByClusterCount(t *testing.T) {
+	counts := func(c ...int) map[int]AssignedOrder {
+		orders := map[int]AssignedOrder{}
+		for i, n := range c {
+			if n > 0 {
+				orders[i+1] = AssignedOrder{OrderExists: true, Count: n}
+			}
+		}
+		return orders
+	}
+
+	tests := []struct {
+		name     string
+		orders   map[int]AssignedOrder
+		clusters int
+		want     []int // prover of each cluster
+	}{
+		{"one cluster, two busy provers", counts(0, 3, 2), 1, []int{2}},
+		{"one cluster, three busy provers", counts(1, 3, 2), 1, []int{2}},
+		{"two clusters, two busy provers", counts(5, 1, 0), 2, []int{1, 2}},
+		{"two clusters, three busy provers", counts(1, 3, 2), 2, []int{2, 3}},
+		{"three clusters, two busy provers", counts(2, 1, 0), 3, []int{1, 1, 2}},
+		{"three clusters, three busy provers", counts(1, 3, 2), 3, []int{1, 2, 3}},
+		{"three clusters, skewed orders", counts(9, 1, 1), 3, []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClusters(t, make([]string, tt.clusters)...)
+			d := decideAction([]int{1, 2, 3}, tt.orders, nil, 0, len(clusters), false, false)
+
+			var got []int
+			switch d.Action {
+			case SwitchTo:
+				got = slices.Repeat([]int{d.Provers[0]}, len(clusters))
+			case Split:
+				if len(d.Provers) > len(clusters) {
+					t.Fatalf("split across %v with %d clusters", d.Provers, len(clusters))
+				}
+				got = splitAssignment(d.Provers, d.Weights)
+			default:
+				t.Fatalf("decided %v", d)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v from %+v, want %v", got, d, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitAssignmentWithinGroups(t *testing.T) {
+	setClusters(t, "eu", "us", "eu", "us")
+	got := splitAssignment([]int{1, 2}, []int{1, 1})
+	if want := []int{1, 1, 2, 2}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAllocateClusters(t *testing.T) {
+	tests := []struct {
+		n       int
+		weights []int
+		want    []int
+	}{
+		{4, ratioWeights([]float64{2, 1, 1}), []int{2, 1, 1}},
+		{5, ratioWeights([]float64{1.5, 1}), []int{3, 2}},
+		{10, ratioWeights([]float64{1.5, 1}), []int{6, 4}},
+		{3, []int{1, 1}, []int{2, 1}},
+		// More provers than clusters: the largest remainders win.
+		{2, []int{1, 1, 1}, []int{1, 1, 0}},
+		{1, []int{1, 3}, []int{0, 1}},
+		// Every prover gets at least one, taken from the largest share.
+		{3, []int{10, 1, 1}, []int{1, 1, 1}},
+		{4, []int{10, 1, 1}, []int{2, 1, 1}},
+		{0, []int{1, 1}, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		if got := allocateClusters(tt.n, tt.weights); !slices.Equal(got, tt.want) {
+			t.Errorf("allocateClusters(%d, %v) = %v, want %v", tt.n, tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestAllocateClustersSumsToTotal(t *testing.T) {
+	ratios := [][]float64{
+		{1}, {1, 1}, {2, 1, 1}, {1.5, 1}, {0.1, 0.2, 0.7}, {100, 1}, {1, 1, 1, 1, 1}, {3.333, 1, 0.5},
+	}
+	for _, ratio := range ratios {
+		weights := ratioWeights(ratio)
+		for n := 0; n <= 12; n++ {
+			got := allocateClusters(n, weights)
+			sum := 0
+			for _, c := range got {
+				if c < 0 {
+					t.Errorf("allocateClusters(%d, %v) = %v, negative share", n, ratio, got)
+				}
+				sum += c
+			}
+			if sum != n {
+				t.Errorf("allocateClusters(%d, %v) = %v, sums to %d", n, ratio, got, sum)
+			}
+			if n >= len(weights) && slices.Contains(got, 0) {
+				t.Errorf("allocateClusters(%d, %v) = %v, a prover got none", n, ratio, got)
+			}
+		}
+	}
+}
+
+func TestRatioWeights(t *testing.T) {
+	if got, want := ratioWeights([]float64{1.5, 1}), []int{1500000, 1000000}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// A ratio too small to keep still weighs something.
+	if got := ratioWeights([]float64{1, 1e-9}); got[1] != 1 {
+		t.Errorf("got %v, want the tiny ratio kept at 1", got)
+	}
+	if got := ratioWeights(nil); got != nil {
+		t.Errorf("got %v for no ratio", got)
+	}
+}
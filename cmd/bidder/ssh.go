@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sshDialTimeout       = 10 * time.Second
+	sshKeepaliveInterval = 30 * time.Second
+	sshRetryBaseDelay    = time.Second
+)
+
+// errSSHTimeout is returned when a remote command does not finish within
+// sshTimeout.
+var errSSHTimeout = errors.New("ssh command timed out")
+
+// SSHError reports a docker compose command that failed on a cluster.
+type SSHError struct {
+	ClusterIP string
+	Action    string
+	ExitCode  int    // the remote exit status, or -1 if the command didn't exit
+	Output    string // what the command wrote to stdout and stderr
+	Err       error
+}
+
+func newSSHError(cluster Cluster, action string, out []byte, err error) *SSHError {
+	e := &SSHError{ClusterIP: cluster.IP, Action: action, ExitCode: -1, Output: string(out), Err: err}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitStatus()
+	}
+	return e
+}
+
+func (e *SSHError) Error() string {
+	return fmt.Sprintf("[%s] docker compose %s: %v", e.ClusterIP, e.Action, e.Err)
+}
+
+func (e *SSHError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the command didn't finish within sshTimeout.
+func (e *SSHError) Timeout() bool { return errors.Is(e.Err, errSSHTimeout) }
+
+// AuthFailed reports whether the cluster rejected our credentials, or we
+// rejected its host key.
+func (e *SSHError) AuthFailed() bool { return sshAuthFailed(e.Err) }
+
+func sshAuthFailed(err error) bool {
+	var keyErr *knownhosts.KeyError
+	// x/crypto/ssh has no error type for a failed handshake auth.
+	return errors.As(err, &keyErr) || strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// retryableSSH reports whether err may be transient, as opposed to the
+// remote command failing or the host rejecting our key or credentials.
+func retryableSSH(err error) bool {
+	var exitErr *ssh.ExitError
+	return !errors.As(err, &exitErr) && !sshAuthFailed(err)
+}
+
+// expandHome resolves a leading "~/" against the local home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// defaultAuth mirrors what the ssh binary would try without explicit
+// credentials: the running agent, then the standard identity files.
+func defaultAuth() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := os.ReadFile(expandHome("~/.ssh/" + name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	return methods
+}
+
+func sshClientConfig(cluster Cluster) (*ssh.ClientConfig, error) {
+	user := cluster.User
+	if user == "" {
+		user = sshUser
+	}
+
+	cfg := &ssh.ClientConfig{
+		User:    user,
+		Timeout: sshDialTimeout,
+	}
+
+	policy := hostKeyPolicy
+	switch {
+	case cluster.Password != "":
+		cfg.Auth = []ssh.AuthMethod{ssh.Password(cluster.Password)}
+		if policy == "" {
+			// Password clusters have always been reached with host key
+			// checking disabled.
+			policy = hostKeyNo
+		}
+	case cluster.KeyPath != "":
+		key, err := os.ReadFile(expandHome(cluster.KeyPath))
+		if err != nil {
+			return nil, fmt.Errorf("read key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("parse key %s: %w", cluster.KeyPath, err)
+		}
+		cfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	default:
+		cfg.Auth = defaultAuth()
+		if len(cfg.Auth) == 0 {
+			return nil, errors.New("no password, key, or ssh-agent identities available")
+		}
+	}
+
+	switch policy {
+	case hostKeyNo:
+		cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	case hostKeyAcceptNew:
+		hostKeys, err := loadKnownHosts(true)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HostKeyCallback = acceptNewHostKeys(hostKeys)
+	default:
+		hostKeys, err := loadKnownHosts(false)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HostKeyCallback = hostKeys
+	}
+	return cfg, nil
+}
+
+// knownHostsMu serializes appends to knownHostsFile.
+var knownHostsMu sync.Mutex
+
+// loadKnownHosts parses knownHostsFile, creating it first if create is set.
+func loadKnownHosts(create bool) (ssh.HostKeyCallback, error) {
+	path := expandHome(knownHostsFile)
+	if create {
+		knownHostsMu.Lock()
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err == nil {
+				err = f.Close()
+			}
+		}
+		knownHostsMu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("create known_hosts: %w", err)
+		}
+	}
+
+	hostKeys, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("load known_hosts: %w", err)
+	}
+	return hostKeys, nil
+}
+
+// acceptNewHostKeys trusts and records the key of a host knownHostsFile has
+// never seen, and otherwise defers to hostKeys, so a changed key is still
+// rejected.
+func acceptNewHostKeys(hostKeys ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := hostKeys(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		f, err := os.OpenFile(expandHome(knownHostsFile), os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("record host key: %w", err)
+		}
+		defer f.Close()
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return fmt.Errorf("record host key: %w", err)
+		}
+		slog.Warn("Trusting new SSH host key", "host", hostname,
+			"fingerprint", ssh.FingerprintSHA256(key), "known_hosts", knownHostsFile)
+		return nil
+	}
+}
+
+var (
+	poolMu sync.Mutex
+	// pool holds one long-lived connection per cluster, keyed by clusterKey.
+	pool = map[string]*ssh.Client{}
+	// poolUsers counts the commands running over each pooled or retired
+	// connection.
+	poolUsers = map[*ssh.Client]int{}
+	// retired holds the connections taken out of the pool while in use, to be
+	// closed once their last command is done.
+	retired = map[*ssh.Client]bool{}
+)
+
+// sshDial opens the network connection to a cluster. Replacing it points
+// every SSH command at another transport, such as an in-process server.
+var sshDial = (&net.Dialer{Timeout: sshDialTimeout}).DialContext
+
+// dialSSH opens a new connection to the cluster, giving up if ctx is done
+// before the handshake completes.
+func dialSSH(ctx context.Context, cluster Cluster, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := clusterKey(cluster)
+
+	conn, err := sshDial(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errSSHTimeout
+		}
+		return nil, fmt.Errorf("ssh dial: %w", err)
+	}
+
+	// Closing the connection unblocks the handshake.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if !stop() || err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, errSSHTimeout
+		}
+		return nil, fmt.Errorf("ssh handshake: %w", err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// pooledClient returns the pooled connection to the cluster, dialing one if
+// there is none yet. releaseClient must be called once it is no longer used.
+func pooledClient(ctx context.Context, cluster Cluster, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	key := clusterKey(cluster)
+
+	poolMu.Lock()
+	client := pool[key]
+	if client != nil {
+		poolUsers[client]++
+	}
+	poolMu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	client, err := dialSSH(ctx, cluster, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	poolMu.Lock()
+	if old := pool[key]; old != nil {
+		// Another goroutine dialed first; keep its connection.
+		poolUsers[old]++
+		poolMu.Unlock()
+		client.Close()
+		return old, nil
+	}
+	pool[key] = client
+	poolUsers[client]++
+	poolMu.Unlock()
+
+	go keepalive(key, client)
+	return client, nil
+}
+
+// dropClient closes client and removes it from the pool if still pooled.
+func dropClient(key string, client *ssh.Client) {
+	poolMu.Lock()
+	if pool[key] == client {
+		delete(pool, key)
+	}
+	poolMu.Unlock()
+	client.Close()
+}
+
+// releaseClient records that a command got from pooledClient is done with
+// client, closing it if it was retired and this was its last user.
+func releaseClient(client *ssh.Client) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	if poolUsers[client]--; poolUsers[client] > 0 {
+		return
+	}
+	delete(poolUsers, client)
+	if retired[client] {
+		delete(retired, client)
+		client.Close()
+	}
+}
+
+// retireClients takes the pooled connections to the clusters with the given
+// keys out of the pool, so the next command dials a new one, and closes each
+// once the commands running over it are done.
+func retireClients(keys []string) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	for _, key := range keys {
+		client := pool[key]
+		if client == nil {
+			continue
+		}
+		delete(pool, key)
+		if poolUsers[client] > 0 {
+			retired[client] = true
+		} else {
+			client.Close()
+		}
+	}
+}
+
+// closePool closes every pooled and retired connection. They are redialed on
+// next use.
+func closePool() {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	for key, client := range pool {
+		client.Close()
+		delete(pool, key)
+	}
+	for client := range retired {
+		client.Close()
+	}
+	clear(retired)
+	clear(poolUsers)
+}
+
+// keepalive pings the connection every sshKeepaliveInterval and drops it from
+// the pool once it stops answering or closes.
+func keepalive(key string, client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			dropClient(key, client)
+			return
+		case <-ticker.C:
+		}
+
+		// A hung peer never replies, so close the connection if it takes
+		// too long.
+		timer := time.AfterFunc(sshDialTimeout, func() { client.Close() })
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		timer.Stop()
+		if err != nil {
+			slog.Warn("SSH keepalive failed, dropping connection", "cluster", key, "error", err)
+			dropClient(key, client)
+			return
+		}
+	}
+}
+
+// runSSH runs cmd on the cluster over its pooled connection, redialing once
+// if the pooled connection has gone stale. If ctx is done first the
+// connection is closed, aborting the command.
+func runSSH(ctx context.Context, cluster Cluster, cfg *ssh.ClientConfig, cmd string) ([]byte, error) {
+	key := clusterKey(cluster)
+
+	var session *ssh.Session
+	var client *ssh.Client
+	for attempt := 0; session == nil; attempt++ {
+		var err error
+		client, err = pooledClient(ctx, cluster, cfg)
+		if err != nil {
+			return nil, err
+		}
+		session, err = client.NewSession()
+		if err != nil {
+			dropClient(key, client)
+			releaseClient(client)
+			if ctx.Err() != nil {
+				return nil, errSSHTimeout
+			}
+			if attempt > 0 {
+				return nil, fmt.Errorf("ssh session: %w", err)
+			}
+		}
+	}
+	defer releaseClient(client)
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() { dropClient(key, client) })
+	defer stop()
+
+	out, err := session.CombinedOutput(cmd)
+	if err != nil && ctx.Err() != nil {
+		return out, errSSHTimeout
+	}
+	return out, err
+}
+
+func sshDockerCompose(ctx context.Context, cluster Cluster, prover int, action string) error {
+	_, err := dockerCompose(ctx, cluster, prover, action)
+	return err
+}
+
+// buildCommand returns the shell command that runs
+// "<compose command> [-f <file>] [-p <project>] <action>" in the folder of
+// prover on the cluster.
+func buildCommand(cluster Cluster, prover int, action string) string {
+	compose := cluster.compose()
+	if file := cluster.composeFile(prover); file != "" {
+		compose += " -f " + remotePath(file)
+	}
+	if project := proverProjects[prover]; project != "" {
+		compose += " -p " + project
+	}
+	return fmt.Sprintf("cd %s && %s %s", remotePath(cluster.folder(prover)), compose, action)
+}
+
+// dockerCompose runs buildCommand's command for action on the cluster and
+// returns the command's stdout and stderr. Transient SSH failures are retried
+// up to sshRetries attempts in total. Cancelling ctx aborts the command and
+// any retries.
+func dockerCompose(ctx context.Context, cluster Cluster, prover int, action string) ([]byte, error) {
+	remoteCmd := buildCommand(cluster, prover, action)
+
+	if dryRun {
+		slog.Info("Dry run: would run docker compose",
+			"cluster_ip", cluster.IP, "port", cluster.Port, "action", action, "command", remoteCmd)
+		return nil, nil
+	}
+
+	cfg, err := sshClientConfig(cluster)
+	if err != nil {
+		sshFailuresTotal.WithLabelValues(cluster.IP, action).Inc()
+		slog.Error("SSH client config failed", "cluster_ip", cluster.IP, "action", action, "error", err)
+		return nil, newSSHError(cluster, action, nil, fmt.Errorf("ssh config: %w", err))
+	}
+
+	start := time.Now()
+	var out []byte
+	for attempt := 1; ; attempt++ {
+		cmdCtx, cancel := context.WithTimeout(ctx, sshTimeout)
+		out, err = runSSH(cmdCtx, cluster, cfg, remoteCmd)
+		cancel()
+		if err == nil || ctx.Err() != nil || attempt >= sshRetries || !retryableSSH(err) {
+			break
+		}
+
+		backoff := sshRetryBaseDelay << (attempt - 1)
+		backoff += time.Duration(rand.Int64N(int64(backoff)))
+		slog.Warn("docker compose failed, retrying", "cluster_ip", cluster.IP, "action", action,
+			"attempt", attempt, "max_attempts", sshRetries, "backoff", backoff.Round(time.Millisecond).String(), "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+	}
+	attrs := []any{
+		"cluster_ip", cluster.IP,
+		"action", action,
+		"folder", cluster.folder(prover),
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+
+	if ctx.Err() != nil {
+		slog.Warn("docker compose cancelled", attrs...)
+		return out, newSSHError(cluster, action, out, ctx.Err())
+	}
+	if errors.Is(err, errSSHTimeout) {
+		sshFailuresTotal.WithLabelValues(cluster.IP, action).Inc()
+		slog.Error("docker compose timed out", append(attrs, "timeout", sshTimeout.String())...)
+		return out, newSSHError(cluster, action, out, fmt.Errorf("%w after %s", err, sshTimeout))
+	}
+	if err != nil {
+		sshFailuresTotal.WithLabelValues(cluster.IP, action).Inc()
+		slog.Error("docker compose failed", append(attrs, "error", err, "output", string(out))...)
+		sshErr := newSSHError(cluster, action, out, err)
+		if sshErr.AuthFailed() {
+			sshAuthFailuresTotal.WithLabelValues(cluster.IP).Inc()
+		}
+		return out, sshErr
+	}
+
+	slog.Info("docker compose", attrs...)
+	return out, nil
+}
+
+// remotePath quotes path for the remote shell so that it survives spaces and
+// still has a leading "~" and any $VAR expanded there, whatever the login
+// shell's rules for unquoted tildes.
+func remotePath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = "$HOME" + path[1:]
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`").Replace(path) + `"`
+}
+
+type composeContainer struct {
+	Service string `json:"Service"`
+	State   string `json:"State"`
+}
+
+// parseComposePS decodes "docker compose ps --format json", which is a JSON
+// array on older Compose releases and one object per line on newer ones.
+func parseComposePS(out []byte) ([]composeContainer, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	var containers []composeContainer
+	if out[0] == '[' {
+		err := json.Unmarshal(out, &containers)
+		return containers, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var c composeContainer
+		if err := dec.Decode(&c); err != nil {
+			return nil, err
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// verifyRunning checks that every service of the compose project of prover is
+// running, since "docker compose start" exits 0 even if a container crashes
+// straight away.
+func verifyRunning(ctx context.Context, cluster Cluster, prover int) error {
+	if dryRun {
+		return nil
+	}
+	if isComposeV1(cluster.compose()) {
+		return verifyRunningV1(ctx, cluster, prover)
+	}
+
+	folder := cluster.folder(prover)
+	out, err := dockerCompose(ctx, cluster, prover, "ps --all --format json")
+	if err != nil {
+		return err
+	}
+	containers, err := parseComposePS(out)
+	if err != nil {
+		return fmt.Errorf("[%s] parse docker compose ps: %w", cluster.IP, err)
+	}
+	if len(containers) == 0 {
+		return fmt.Errorf("[%s] no containers found in %s", cluster.IP, folder)
+	}
+
+	var notRunning []string
+	for _, c := range containers {
+		if c.State != "running" {
+			notRunning = append(notRunning, fmt.Sprintf("%s (%s)", c.Service, c.State))
+		}
+	}
+	if len(notRunning) > 0 {
+		return fmt.Errorf("[%s] services not running in %s: %s", cluster.IP, folder, strings.Join(notRunning, ", "))
+	}
+	return nil
+}
+
+// isComposeV1 reports whether cmd is the standalone docker-compose binary,
+// whose v1 releases have no JSON output.
+func isComposeV1(cmd string) bool {
+	fields := strings.Fields(cmd)
+	return len(fields) > 0 && filepath.Base(fields[len(fields)-1]) == "docker-compose"
+}
+
+// verifyRunningV1 is verifyRunning for docker-compose v1, comparing the
+// project's services against the ones running.
+func verifyRunningV1(ctx context.Context, cluster Cluster, prover int) error {
+	folder := cluster.folder(prover)
+	all, err := dockerCompose(ctx, cluster, prover, "ps --services")
+	if err != nil {
+		return err
+	}
+	services := strings.Fields(string(all))
+	if len(services) == 0 {
+		return fmt.Errorf("[%s] no services found in %s", cluster.IP, folder)
+	}
+
+	up, err := runningServices(ctx, cluster, prover)
+	if err != nil {
+		return err
+	}
+
+	var notRunning []string
+	for _, svc := range services {
+		if !slices.Contains(up, svc) {
+			notRunning = append(notRunning, svc)
+		}
+	}
+	if len(notRunning) > 0 {
+		return fmt.Errorf("[%s] services not running in %s: %s", cluster.IP, folder, strings.Join(notRunning, ", "))
+	}
+	return nil
+}
+
+// runningServices lists the services of the compose project of prover that
+// have a running container.
+func runningServices(ctx context.Context, cluster Cluster, prover int) ([]string, error) {
+	if isComposeV1(cluster.compose()) {
+		out, err := dockerCompose(ctx, cluster, prover, "ps --services --filter status=running")
+		return strings.Fields(string(out)), err
+	}
+
+	out, err := dockerCompose(ctx, cluster, prover, "ps --format json")
+	if err != nil {
+		return nil, err
+	}
+	containers, err := parseComposePS(out)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] parse docker compose ps: %w", cluster.IP, err)
+	}
+
+	var services []string
+	for _, c := range containers {
+		if c.State == "running" {
+			services = append(services, c.Service)
+		}
+	}
+	return services, nil
+}
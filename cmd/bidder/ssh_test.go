@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	cluster1 = "10.0.0.1:22"
+	cluster2 = "10.0.0.2:22"
+
+	// The default compose commands for each prover, without their action.
+	prover1 = `cd "$HOME/prover-1-aux-cluster" && docker compose`
+	prover2 = `cd "$HOME/prover-2-aux-cluster" && docker compose`
+)
+
+func TestSwitchProverStopFirst(t *testing.T) {
+	withConfigLines(t, "switch_order: stop_first")
+	srv := startSSHServer(t)
+
+	if err := switchProver(context.Background(), 1, "test"); err != nil {
+		t.Fatalf("switchProver: %v", err)
+	}
+	want := []string{
+		`cd "$HOME/prover-2-aux-cluster" && docker compose stop`,
+		`cd "$HOME/prover-1-aux-cluster" && docker compose start`,
+	}
+	for _, c := range []string{cluster1, cluster2} {
+		if got := srv.lifecycleOn(c); !slices.Equal(got, want) {
+			t.Errorf("%s got %q, want %q", c, got, want)
+		}
+	}
+	if currentActiveProver != 1 || !slices.Equal(clusterProvers, []int{1, 1}) {
+		t.Errorf("active %d, clusters %v, want 1 everywhere", currentActiveProver, clusterProvers)
+	}
+
+	// Switching again only touches what changes.
+	srv.reset()
+	lastSwitch = lastSwitch.AddDate(-1, 0, 0)
+	if err := switchProver(context.Background(), 2, "test"); err != nil {
+		t.Fatalf("switchProver: %v", err)
+	}
+	want = []string{
+		`cd "$HOME/prover-1-aux-cluster" && docker compose stop`,
+		`cd "$HOME/prover-2-aux-cluster" && docker compose start`,
+	}
+	if got := srv.lifecycleOn(cluster2); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSwitchProverStartFirst(t *testing.T) {
+	withConfigLines(t, "switch_order: start_first")
+	srv := startSSHServer(t)
+
+	if err := switchProver(context.Background(), 2, "test"); err != nil {
+		t.Fatalf("switchProver: %v", err)
+	}
+	want := []string{
+		`cd "$HOME/prover-2-aux-cluster" && docker compose start`,
+		`cd "$HOME/prover-1-aux-cluster" && docker compose stop`,
+	}
+	for _, c := range []string{cluster1, cluster2} {
+		if got := srv.lifecycleOn(c); !slices.Equal(got, want) {
+			t.Errorf("%s got %q, want %q", c, got, want)
+		}
+	}
+}
+
+func TestStartFirstKeepsOldProverWhenStartFails(t *testing.T) {
+	withConfigLines(t, "switch_order: start_first")
+	srv := startSSHServer(t)
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if cluster == cluster2 && strings.HasSuffix(cmd, "prover-2-aux-cluster\" && docker compose start") {
+			return "Error response from daemon: no such container\n", 1, true
+		}
+		return "", 0, false
+	}
+
+	err := switchProver(context.Background(), 2, "test")
+	if err == nil || !strings.Contains(err.Error(), cluster2) {
+		t.Fatalf("got %v, want an error naming %s", err, cluster2)
+	}
+	// Nothing was stopped on the cluster that failed to start.
+	for _, cmd := range srv.lifecycleOn(cluster2) {
+		if strings.HasSuffix(cmd, " stop") {
+			t.Errorf("%s got %q after its start failed", cluster2, cmd)
+		}
+	}
+	if !slices.Equal(clusterProvers, []int{2, 0}) || outOfSync[cluster2] != 2 {
+		t.Errorf("clusters %v, out of sync %v; want [2 0] with %s to retry", clusterProvers, outOfSync, cluster2)
+	}
+}
+
+func TestSSHExitStatus(t *testing.T) {
+	withConfigLines(t)
+	srv := startSSHServer(t)
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		return "Error response from daemon: no such container\n", 3, strings.HasSuffix(cmd, " start")
+	}
+
+	err := sshDockerCompose(context.Background(), clusters[0], 1, "start")
+	var sshErr *SSHError
+	if !errors.As(err, &sshErr) || sshErr.ExitCode != 3 || !strings.Contains(sshErr.Output, "no such container") {
+		t.Fatalf("got %v, want exit status 3 with the command's output", err)
+	}
+	// A command that ran and failed is not retried.
+	if got := srv.lifecycleOn(cluster1); len(got) != 1 {
+		t.Errorf("sent %q, want one start", got)
+	}
+	if err := sshDockerCompose(context.Background(), clusters[0], 1, "stop"); err != nil {
+		t.Errorf("stop: %v", err)
+	}
+}
+
+func TestSplitProversCommands(t *testing.T) {
+	withConfigLines(t)
+	srv := startSSHServer(t)
+
+	if err := splitProvers(context.Background(), []int{1, 2}, []int{1, 1}, "test"); err != nil {
+		t.Fatalf("splitProvers: %v", err)
+	}
+	if !splitMode || !slices.Equal(splitActive, []int{1, 2}) || !slices.Equal(clusterProvers, []int{1, 2}) {
+		t.Fatalf("split %v %v, clusters %v; want [1 2] on [1 2]", splitMode, splitActive, clusterProvers)
+	}
+	for c, want := range map[string][]string{
+		cluster1: {
+			`cd "$HOME/prover-2-aux-cluster" && docker compose stop`,
+			`cd "$HOME/prover-1-aux-cluster" && docker compose start`,
+		},
+		cluster2: {
+			`cd "$HOME/prover-1-aux-cluster" && docker compose stop`,
+			`cd "$HOME/prover-2-aux-cluster" && docker compose start`,
+		},
+	} {
+		if got := srv.lifecycleOn(c); !slices.Equal(got, want) {
+			t.Errorf("%s got %q, want %q", c, got, want)
+		}
+	}
+}
+
+func TestComposeOverrides(t *testing.T) {
+	loadTestConfig(t, `api_endpoint: http://127.0.0.1:1/is-assigned
+state_file: `+t.TempDir()+`/state.json
+compose_cmd: docker compose
+clusters:
+  - ip: 10.0.0.1
+    password: pass1
+    folders:
+      1: /opt/prover one
+    compose_files:
+      1: docker-compose.gpu.yml
+  - ip: 10.0.0.2
+    password: pass2
+    compose_cmd: docker-compose
+provers:
+  - address: "0x1111111111111111111111111111111111111111"
+    folder: ~/p1
+    compose_file: docker-compose.prod.yml
+    project: prover-one
+  - address: "0x2222222222222222222222222222222222222222"
+    folder: ~/p2
+`)
+	srv := startSSHServer(t)
+
+	if err := switchProver(context.Background(), 1, "test"); err != nil {
+		t.Fatalf("switchProver: %v", err)
+	}
+	for c, want := range map[string][]string{
+		cluster1: {
+			`cd "$HOME/p2" && docker compose stop`,
+			`cd "/opt/prover one" && docker compose -f "docker-compose.gpu.yml" -p prover-one start`,
+		},
+		cluster2: {
+			`cd "$HOME/p2" && docker-compose stop`,
+			`cd "$HOME/p1" && docker-compose -f "docker-compose.prod.yml" -p prover-one start`,
+		},
+	} {
+		if got := srv.lifecycleOn(c); !slices.Equal(got, want) {
+			t.Errorf("%s got %q, want %q", c, got, want)
+		}
+	}
+}
+
+func TestSSHAuthFailure(t *testing.T) {
+	withConfigLines(t)
+	srv := startSSHServer(t)
+	clusters[1].Password = "wrong"
+
+	err := sshDockerCompose(context.Background(), clusters[1], 1, "stop")
+	var sshErr *SSHError
+	if !errors.As(err, &sshErr) || !sshErr.AuthFailed() {
+		t.Fatalf("got %v, want an authentication failure", err)
+	}
+	if got := srv.lifecycle(); len(got) != 0 {
+		t.Errorf("commands ran without authenticating: %v", got)
+	}
+}
+
+func TestStatusDuringSwitch(t *testing.T) {
+	withConfigLines(t, "switch_order: stop_first")
+	srv := startSSHServer(t)
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if strings.HasSuffix(cmd, " stop") {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+		}
+		return "", 0, false
+	}
+	done := make(chan error)
+	go func() { done <- switchProver(context.Background(), 1, "test") }()
+
+	<-blocked
+	// The switch has held up the poll loop for longer than /healthz allows.
+	lastPollCompleted.Store(time.Now().Add(-time.Hour).UnixNano())
+	answered := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+		answered <- rec.Code
+	}()
+	select {
+	case code := <-answered:
+		if code != http.StatusOK {
+			t.Errorf("/status returned %d during a switch", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("/status blocked behind a switch")
+	}
+	if code := healthz(); code != http.StatusOK {
+		t.Errorf("/healthz returned %d during a switch", code)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("switchProver: %v", err)
+	}
+	if !slices.Equal(clusterProvers, []int{1, 1}) {
+		t.Errorf("clusters %v, want 1 everywhere", clusterProvers)
+	}
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz returned %d with no poll for an hour and no switch", code)
+	}
+}
+
+// healthz returns the status code /healthz answers with.
+func healthz() int {
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return rec.Code
+}
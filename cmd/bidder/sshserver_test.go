@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// composeActions are the compose actions testSSHServer understands, longest
+// first so "ps --all --format json" isn't taken for a shorter one.
+var composeActions = []string{
+	"ps --services --filter status=running", "ps --services",
+	"ps --all --format json", "ps --format json", "restart", "unpause", "pause", "start", "stop",
+}
+
+// sshCommand is one command testSSHServer received.
+type sshCommand struct {
+	Cluster string // clusterKey of the cluster it was sent to
+	Command string
+}
+
+// testSSHServer is an in-process SSH server standing in for every cluster.
+// It accepts each cluster's password, records the commands it is sent, and
+// answers them from script, or else like docker compose would: start and
+// stop change whether the project in the command runs and ps, in the v2 JSON
+// or the v1 service list form, reports it.
+type testSSHServer struct {
+	config *ssh.ServerConfig
+	addrs  map[string]string // clusterKey → listener address
+
+	mu       sync.Mutex
+	commands []sshCommand
+	running  map[string]bool // cluster and project → running
+	// script, if set, answers a command instead; ok false falls through to
+	// the compose model.
+	script func(cluster, cmd string) (out string, status int, ok bool)
+}
+
+// startSSHServer starts a testSSHServer for the loaded clusters and points
+// sshDial at it. Pooled connections are closed when the test ends.
+func startSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSSHServer{addrs: map[string]string{}, running: map[string]bool{}}
+	passwords := map[string]string{}
+	for _, c := range clusters {
+		passwords[clusterKey(c)] = c.Password
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			// The listener the client reached tells which cluster it meant.
+			for key, addr := range s.addrs {
+				if addr == meta.LocalAddr().String() && passwords[key] == string(password) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("wrong password for %s", meta.User())
+		},
+	}
+	s.config.AddHostKey(signer)
+
+	for key := range passwords {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		s.addrs[key] = ln.Addr().String()
+		go s.accept(ln, key)
+	}
+
+	orig := sshDial
+	sshDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		target, ok := s.addrs[addr]
+		if !ok {
+			return nil, fmt.Errorf("no test cluster at %s", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}
+	t.Cleanup(func() {
+		closePool()
+		sshDial = orig
+	})
+	closePool()
+	return s
+}
+
+func (s *testSSHServer) accept(ln net.Listener, cluster string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn, cluster)
+	}
+}
+
+func (s *testSSHServer) serve(conn net.Conn, cluster string) {
+	defer conn.Close()
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, chReqs, cluster)
+	}
+}
+
+func (s *testSSHServer) session(ch ssh.Channel, reqs <-chan *ssh.Request, cluster string) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" || len(req.Payload) < 4 {
+			req.Reply(false, nil)
+			continue
+		}
+		n := binary.BigEndian.Uint32(req.Payload)
+		cmd := string(req.Payload[4 : 4+n])
+		req.Reply(true, nil)
+
+		out, status := s.exec(cluster, cmd)
+		ch.Write([]byte(out))
+		ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, uint32(status)))
+		return
+	}
+}
+
+// exec records cmd and returns its output and exit status.
+func (s *testSSHServer) exec(cluster, cmd string) (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, sshCommand{Cluster: cluster, Command: cmd})
+	if s.script != nil {
+		if out, status, ok := s.script(cluster, cmd); ok {
+			return out, status
+		}
+	}
+
+	project, action, ok := splitComposeCommand(cmd)
+	if !ok {
+		return "unknown command\n", 127
+	}
+	key := cluster + " " + project
+	switch action {
+	case "start", "restart", "unpause":
+		s.running[key] = true
+	case "stop", "pause":
+		s.running[key] = false
+	case "ps --all --format json":
+		if s.running[key] {
+			return `{"Service":"prover","State":"running"}` + "\n", 0
+		}
+		return `{"Service":"prover","State":"exited"}` + "\n", 0
+	case "ps --format json":
+		if s.running[key] {
+			return `{"Service":"prover","State":"running"}` + "\n", 0
+		}
+	case "ps --services":
+		return "prover\n", 0
+	case "ps --services --filter status=running":
+		if s.running[key] {
+			return "prover\n", 0
+		}
+	}
+	return "", 0
+}
+
+// splitComposeCommand splits a command built by buildCommand into the part
+// naming the project, its folder and compose flags, and the action.
+func splitComposeCommand(cmd string) (project, action string, ok bool) {
+	for _, a := range composeActions {
+		if p, found := strings.CutSuffix(cmd, " "+a); found {
+			return p, a, true
+		}
+	}
+	return "", "", false
+}
+
+// lifecycle returns the start, stop, pause and unpause commands received so
+// far, in order, leaving out the ps checks around them.
+func (s *testSSHServer) lifecycle() []sshCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cmds []sshCommand
+	for _, c := range s.commands {
+		if _, action, ok := splitComposeCommand(c.Command); ok && !strings.HasPrefix(action, "ps ") {
+			cmds = append(cmds, c)
+		}
+	}
+	return cmds
+}
+
+// lifecycleOn is lifecycle for one cluster, as bare commands.
+func (s *testSSHServer) lifecycleOn(cluster string) []string {
+	var cmds []string
+	for _, c := range s.lifecycle() {
+		if c.Cluster == cluster {
+			cmds = append(cmds, c.Command)
+		}
+	}
+	return cmds
+}
+
+// crash marks project, a command up to its compose action, as stopped on
+// cluster, as if its containers had exited.
+func (s *testSSHServer) crash(cluster, project string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[cluster+" "+project] = false
+}
+
+// reset forgets the commands received so far, but not what runs.
+func (s *testSSHServer) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"runtime/pprof"
+	"time"
+)
+
+// watchStall exits the process once no poll cycle has completed for
+// stallTimeout, so an orchestrator restarts a main loop that is stuck, say on
+// a deadlock over mu, instead of leaving a process that looks alive. The
+// goroutine stacks are dumped to stderr first to show where it is stuck.
+// loadConfig makes stallTimeout allow for the wait between polls, the longest
+// order poll, a whole switchDeadline and the serving probe, so a slow but
+// progressing switch isn't killed.
+func watchStall(ctx context.Context) {
+	ticker := time.NewTicker(max(stallTimeout/10, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last := startTime
+		if ns := lastPollCompleted.Load(); ns != 0 {
+			last = time.Unix(0, ns)
+		}
+		since := time.Since(last)
+		if since <= stallTimeout || ctx.Err() != nil {
+			continue
+		}
+		slog.Error("Poll loop stalled, exiting so the process is restarted",
+			"since_last_poll", since.Round(time.Second).String(), "stall_timeout", stallTimeout.String())
+		pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+		os.Exit(1)
+	}
+}
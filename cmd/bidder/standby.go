@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// serve makes prover serve on the cluster in warm standby mode by running
+// warmServeAction. If that fails, for instance because the project was never
+// started, the prover is cold-started instead.
+func serve(ctx context.Context, cluster Cluster, prover int) error {
+	err := sshDockerCompose(ctx, cluster, prover, warmServeAction)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	slog.Info("Serve action failed, starting prover", "cluster_ip", cluster.IP, "prover", prover)
+	if startErr := sshDockerCompose(ctx, cluster, prover, "start"); startErr != nil {
+		return errors.Join(err, startErr)
+	}
+	return nil
+}
+
+// standby parks the provers ids on the cluster in warm standby mode by running
+// warmIdleAction, with their containers kept so serve is quick. A prover the
+// action fails on, such as one that isn't running yet, is started and parked
+// again.
+func standby(ctx context.Context, cluster Cluster, ids []int) []error {
+	var errs []error
+	for _, id := range ids {
+		err := sshDockerCompose(ctx, cluster, id, warmIdleAction)
+		if err == nil || ctx.Err() != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if startErr := sshDockerCompose(ctx, cluster, id, "start"); startErr != nil {
+			errs = append(errs, errors.Join(err, startErr))
+			continue
+		}
+		errs = append(errs, sshDockerCompose(ctx, cluster, id, warmIdleAction))
+	}
+	return errs
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+type persistedState struct {
+	ActiveProver   int   `json:"active_prover"`
+	SplitMode      bool  `json:"split_mode"`
+	SplitProvers   []int `json:"split_provers,omitempty"`
+	ClusterProvers []int `json:"cluster_provers,omitempty"`
+	// ActiveSince holds when each running prover became active.
+	ActiveSince map[int]time.Time `json:"active_since,omitempty"`
+	// Unfinished holds the clusters abandoned at the switch deadline, by
+	// clusterKey, with the prover they should be switched to.
+	Unfinished map[string]int `json:"unfinished,omitempty"`
+	// OutOfSync holds the clusters whose last switch failed, by clusterKey,
+	// with the prover reconcile should bring them to.
+	OutOfSync map[string]int `json:"out_of_sync,omitempty"`
+}
+
+// saveState writes the current prover state to stateFile. Callers must hold mu.
+func saveState() {
+	if stateFile == "" || dryRun {
+		return
+	}
+
+	data, err := json.MarshalIndent(persistedState{
+		ActiveProver:   currentActiveProver,
+		SplitMode:      splitMode,
+		SplitProvers:   splitActive,
+		ClusterProvers: clusterProvers,
+		ActiveSince:    activeSince,
+		Unfinished:     unfinished,
+		OutOfSync:      outOfSync,
+	}, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode state", "error", err)
+		return
+	}
+
+	// Write then rename so a crash never leaves a truncated file behind.
+	tmp := filepath.Join(filepath.Dir(stateFile), "."+filepath.Base(stateFile)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		slog.Error("Failed to write state file", "path", stateFile, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, stateFile); err != nil {
+		slog.Error("Failed to write state file", "path", stateFile, "error", err)
+	}
+}
+
+// loadState restores the prover state saved by a previous run so an unchanged
+// order picture does not trigger a switch after a restart.
+func loadState() {
+	if stateFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Ignoring state file", "path", stateFile, "error", err)
+		return
+	}
+
+	var st persistedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		slog.Warn("Ignoring state file", "path", stateFile, "error", err)
+		return
+	}
+
+	// A prover removed from the config since makes the whole file stale.
+	ids := st.SplitProvers
+	if !st.SplitMode && st.ActiveProver != 0 {
+		ids = []int{st.ActiveProver}
+	}
+	// Clusters record no prover as zero.
+	for _, id := range st.ClusterProvers {
+		if id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	ids = slices.AppendSeq(ids, maps.Values(st.Unfinished))
+	ids = slices.AppendSeq(ids, maps.Values(st.OutOfSync))
+	for _, id := range ids {
+		if _, ok := proverFolders[id]; !ok {
+			slog.Warn("Ignoring state file with unknown prover", "path", stateFile, "prover", id)
+			return
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	currentActiveProver = st.ActiveProver
+	splitMode = st.SplitMode
+	splitActive = st.SplitProvers
+	if len(st.ClusterProvers) == len(clusters) {
+		copy(clusterProvers, st.ClusterProvers)
+	}
+	if splitMode {
+		currentActiveProver = 0
+	}
+	// Provers restored without a time count from now.
+	for _, id := range currentState().provers() {
+		if t, ok := st.ActiveSince[id]; ok {
+			activeSince[id] = t
+		}
+	}
+	markActive(time.Now())
+	// Clusters removed from the config since are no longer switched.
+	for _, c := range clusters {
+		key := clusterKey(c)
+		if id, ok := st.Unfinished[key]; ok {
+			unfinished[key] = id
+		}
+		if id, ok := st.OutOfSync[key]; ok {
+			outOfSync[key] = id
+		}
+	}
+	activeProverGauge.Set(float64(currentActiveProver))
+	slog.Info("Restored state", "path", stateFile, "state", currentState().describe())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+)
+
+// writeState saves st to stateFile for loadState to read.
+func writeState(t *testing.T, st persistedState) {
+	t.Helper()
+	data, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stateFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadStateRejectsRemovedProver(t *testing.T) {
+	for name, st := range map[string]persistedState{
+		"cluster":     {ActiveProver: 1, ClusterProvers: []int{1, 3}},
+		"unfinished":  {ActiveProver: 1, Unfinished: map[string]int{cluster1: 3}},
+		"out of sync": {ActiveProver: 1, OutOfSync: map[string]int{cluster2: 3}},
+	} {
+		withConfigLines(t)
+		writeState(t, st)
+		loadState()
+		if currentActiveProver != 0 || slices.ContainsFunc(clusterProvers, func(id int) bool { return id != 0 }) ||
+			len(unfinished) != 0 || len(outOfSync) != 0 {
+			t.Errorf("%s: restored state naming prover 3 of 2", name)
+		}
+	}
+}
+
+func TestLoadStateDropsRemovedClusters(t *testing.T) {
+	withConfigLines(t)
+	writeState(t, persistedState{
+		ActiveProver:   2,
+		ClusterProvers: []int{2, 1},
+		Unfinished:     map[string]int{cluster1: 2, "10.0.0.9:22": 2},
+		OutOfSync:      map[string]int{cluster2: 2, "10.0.0.9:22": 1},
+	})
+	loadState()
+	if currentActiveProver != 2 || !slices.Equal(clusterProvers, []int{2, 1}) {
+		t.Errorf("active %d, clusters %v; want the saved state", currentActiveProver, clusterProvers)
+	}
+	if len(unfinished) != 1 || unfinished[cluster1] != 2 || len(outOfSync) != 1 || outOfSync[cluster2] != 2 {
+		t.Errorf("unfinished %v, out of sync %v; want only the configured clusters", unfinished, outOfSync)
+	}
+}
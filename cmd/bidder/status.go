@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Health state is kept outside mu so probes and metrics still answer while a
+// switch holds the lock.
+var (
+	startTime         = time.Now()
+	lastPollCompleted atomic.Int64 // unix nanoseconds, zero before the first cycle
+	lastOrderSeen     atomic.Int64 // unix nanoseconds, zero before the first order
+	ready             atomic.Bool
+)
+
+// longIdle is how long without any order counts as an idle period worth
+// logging the end of.
+const longIdle = 10 * time.Minute
+
+type pollResult struct {
+	Assigned bool      `json:"assigned"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// orderResult is one order check of the last poll as GET /orders serves it:
+// the API's response as decoded, or the error that stood in for it.
+type orderResult struct {
+	Prover  int            `json:"prover"`
+	Address string         `json:"address"`
+	Group   string         `json:"group,omitempty"` // with ORDER_SOURCE=group
+	Order   *AssignedOrder `json:"order,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Time    time.Time      `json:"time"`
+}
+
+// lastOrders holds the order checks of the last poll that reached the API.
+// Guarded by mu.
+var lastOrders []orderResult
+
+// recordOrders replaces lastOrders with the checks of one poll.
+func recordOrders(results []orderResult) {
+	mu.Lock()
+	defer mu.Unlock()
+	lastOrders = results
+}
+
+// newOrderResult describes the check of prover id, which returned order or
+// failed with err.
+func newOrderResult(id int, group string, order AssignedOrder, err error, t time.Time) orderResult {
+	r := orderResult{Prover: id, Address: proverAddresses[id], Group: group, Time: t}
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Order = &order
+	}
+	return r
+}
+
+type clusterStatus struct {
+	IP          string `json:"ip"`
+	Port        int    `json:"port"`
+	Prover      int    `json:"prover"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+	Group       string `json:"group,omitempty"`
+	Weight      int    `json:"weight"`
+	// Unfinished is set when the last switch abandoned the cluster at its
+	// deadline; the next poll retries it.
+	Unfinished bool `json:"unfinished,omitempty"`
+}
+
+type proverStatus struct {
+	Address               string      `json:"address"`
+	Folder                string      `json:"folder"`
+	ComposeFile           string      `json:"compose_file,omitempty"`
+	Project               string      `json:"project,omitempty"`
+	ActiveSince           *time.Time  `json:"active_since,omitempty"`
+	ActiveDurationSeconds int64       `json:"active_duration_seconds,omitempty"`
+	LastPoll              *pollResult `json:"last_poll,omitempty"`
+}
+
+type statusResponse struct {
+	Version             string               `json:"version"`
+	Commit              string               `json:"commit"`
+	CurrentActiveProver int                  `json:"current_active_prover"`
+	SplitMode           bool                 `json:"split_mode"`
+	SplitProvers        []int                `json:"split_provers,omitempty"`
+	ForceSplit          bool                 `json:"force_split,omitempty"`
+	LastSwitch          *time.Time           `json:"last_switch,omitempty"`
+	Override            *overrideStatus      `json:"override,omitempty"`
+	APIBreaker          *breakerStatus       `json:"api_breaker,omitempty"`
+	Clusters            []clusterStatus      `json:"clusters"`
+	OutOfSync           map[string]int       `json:"out_of_sync,omitempty"` // clusterKey → prover reconcile is retrying
+	LastOrderSeen       *time.Time           `json:"last_order_seen,omitempty"`
+	SinceLastOrder      int64                `json:"seconds_since_last_order"` // counted from startup until the first order
+	Provers             map[int]proverStatus `json:"provers"`
+}
+
+func recordPoll(id int, assigned bool, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	r := pollResult{Assigned: assigned, Time: time.Now()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	lastPoll[id] = r
+	if assigned {
+		if idle := sinceLastOrder(); idle >= longIdle {
+			slog.Info("Order seen after idle period", "prover", id,
+				"idle", idle.Round(time.Second).String(), "first_since_start", lastOrderSeen.Load() == 0)
+		}
+		lastOrderSeen.Store(r.Time.UnixNano())
+	}
+}
+
+// sinceLastOrder returns how long since any prover last had an order, or
+// since startup if none has yet.
+func sinceLastOrder() time.Duration {
+	last := startTime
+	if ns := lastOrderSeen.Load(); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	return time.Since(last)
+}
+
+// markPollCompleted is called by the main loop at the end of every poll cycle.
+func markPollCompleted() {
+	lastPollCompleted.Store(time.Now().UnixNano())
+	ready.Store(currentProvers() != nil)
+}
+
+// handleHealthz fails once no poll cycle has completed for three poll
+// intervals, which means the main loop is stuck. A switch in progress holds up
+// the cycle without the loop being stuck, so it keeps the check passing, lest
+// the process be restarted halfway through; SWITCH_DEADLINE and STALL_TIMEOUT
+// bound a switch that never returns.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if switching() {
+		fmt.Fprintln(w, "ok, switch in progress")
+		return
+	}
+	last := startTime
+	if ns := lastPollCompleted.Load(); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	if since := time.Since(last); since > 3*pollInterval {
+		http.Error(w, fmt.Sprintf("no poll completed in %s", since.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz succeeds once a poll cycle has completed with a prover active.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "no prover active", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	resp := statusResponse{
+		Version:             version,
+		Commit:              commit,
+		CurrentActiveProver: currentActiveProver,
+		SplitMode:           splitMode,
+		SplitProvers:        slices.Clone(splitActive), // encoded after mu is released
+		ForceSplit:          forceSplit,
+		Clusters:            make([]clusterStatus, len(clusters)),
+		OutOfSync:           maps.Clone(outOfSync),
+		SinceLastOrder:      int64(sinceLastOrder().Seconds()),
+		Provers:             make(map[int]proverStatus, len(proverFolders)),
+	}
+	if !lastSwitch.IsZero() {
+		t := lastSwitch
+		resp.LastSwitch = &t
+	}
+	if ns := lastOrderSeen.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		resp.LastOrderSeen = &t
+	}
+	if overrideProver != 0 {
+		resp.Override = &overrideStatus{Prover: overrideProver, ExpiresAt: overrideUntil}
+	}
+	if breakerThreshold > 0 {
+		resp.APIBreaker = &breakerStatus{State: breakerState(), ConsecutiveFailures: breakerFailures}
+		if resp.APIBreaker.State != "closed" {
+			t := breakerOpenUntil
+			resp.APIBreaker.OpenUntil = &t
+		}
+	}
+	for i, c := range clusters {
+		resp.Clusters[i] = clusterStatus{IP: c.IP, Port: c.Port, Prover: clusterProvers[i], Quarantined: quarantined[clusterKey(c)], Group: c.Group,
+			Weight:     c.Weight,
+			Unfinished: unfinished[clusterKey(c)] != 0}
+	}
+	for id, folder := range proverFolders {
+		ps := proverStatus{Address: proverAddresses[id], Folder: folder, ComposeFile: proverComposeFiles[id],
+			Project: proverProjects[id]}
+		if p, ok := lastPoll[id]; ok {
+			ps.LastPoll = &p
+		}
+		if t, ok := activeSince[id]; ok {
+			ps.ActiveSince = &t
+			ps.ActiveDurationSeconds = int64(time.Since(t).Seconds())
+		}
+		resp.Provers[id] = ps
+	}
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Warn("Failed to write status response", "error", err)
+	}
+}
+
+func handleOrders(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	data, err := json.Marshal(lastOrders)
+	mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		slog.Warn("Failed to write orders response", "error", err)
+	}
+}
+
+func startStatusServer(port int) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", handleStatus)
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+	mux.HandleFunc("GET /history", handleHistory)
+	mux.HandleFunc("GET /orders", handleOrders)
+	mux.HandleFunc("GET /plan", handlePlan)
+	mux.HandleFunc("POST /override", control(handleOverride))
+	mux.HandleFunc("DELETE /override", control(handleClearOverride))
+	mux.HandleFunc("PUT /clusters/{ip}/quarantine", control(handleQuarantine))
+	mux.HandleFunc("DELETE /clusters/{ip}/quarantine", control(handleRelease))
+	mux.Handle("GET /metrics", promhttp.Handler())
+	if pprofEnabled {
+		// Profiles expose internals, so they get the same guard as the
+		// mutating endpoints.
+		mux.HandleFunc("GET /debug/pprof/", control(pprof.Index))
+		mux.HandleFunc("GET /debug/pprof/cmdline", control(pprof.Cmdline))
+		mux.HandleFunc("GET /debug/pprof/profile", control(pprof.Profile))
+		mux.HandleFunc("GET /debug/pprof/symbol", control(pprof.Symbol))
+		mux.HandleFunc("POST /debug/pprof/symbol", control(pprof.Symbol))
+		mux.HandleFunc("GET /debug/pprof/trace", control(pprof.Trace))
+		slog.Warn("Profiling endpoints enabled under /debug/pprof/")
+	}
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		slog.Info("Status server listening", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Status server stopped", "error", err)
+		}
+	}()
+
+	return srv
+}
+
+func shutdownServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Status server shutdown", "error", err)
+	}
+}
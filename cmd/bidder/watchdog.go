@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// watchProvers runs checkProvers every healthCheckInterval until ctx is done.
+func watchProvers(ctx context.Context) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkProvers(ctx)
+		}
+	}
+}
+
+// checkProvers restarts the assigned prover on every cluster where its
+// containers are not all running. Switches only touch clusters whose prover is
+// changing, so without this a crashed prover stays down until the next switch.
+// The checks and restarts run without mu, against a snapshot of the
+// assignment, so a slow or unreachable cluster doesn't hold up switches and
+// status queries. Restarts yield to switches as reconcile does, so a switch
+// can't stop the prover underneath one, and only touch clusters no switch has
+// reassigned since their check.
+func checkProvers(ctx context.Context) {
+	type check struct {
+		cluster Cluster
+		prover  int
+	}
+	mu.Lock()
+	var checks []check
+	for i, c := range clusters {
+		if clusterProvers[i] != 0 && !quarantined[clusterKey(c)] {
+			checks = append(checks, check{c, clusterProvers[i]})
+		}
+	}
+	mu.Unlock()
+
+	down := make([]bool, len(checks))
+	var wg sync.WaitGroup
+	for k, chk := range checks {
+		wg.Add(1)
+
+		go func(idx int, cluster Cluster, prover int) {
+			defer wg.Done()
+			select {
+			case sshSem <- struct{}{}:
+				defer func() { <-sshSem }()
+			case <-ctx.Done():
+				return
+			}
+
+			err := verifyRunning(ctx, cluster, prover)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Active prover is not running",
+				"cluster_ip", cluster.IP, "prover", prover, "error", err)
+			down[idx] = true
+		}(k, chk.cluster, chk.prover)
+	}
+	wg.Wait()
+	if !slices.Contains(down, true) || ctx.Err() != nil {
+		return
+	}
+
+	ctx, done, started := beginReconcile(ctx)
+	if !started {
+		slog.Info("Switch or reconcile in progress, restarting crashed provers later")
+		return
+	}
+	defer done()
+
+	mu.Lock()
+	var restarts []check
+	for k, chk := range checks {
+		if !down[k] {
+			continue
+		}
+		key := clusterKey(chk.cluster)
+		i := slices.IndexFunc(clusters, func(c Cluster) bool { return clusterKey(c) == key })
+		if i < 0 || clusterProvers[i] != chk.prover || quarantined[key] {
+			slog.Info("Cluster changed since its check, not restarting", "cluster_ip", chk.cluster.IP, "prover", chk.prover)
+			continue
+		}
+		restarts = append(restarts, check{clusters[i], chk.prover})
+	}
+	mu.Unlock()
+
+	for _, chk := range restarts {
+		wg.Add(1)
+
+		go func(cluster Cluster, prover int) {
+			defer wg.Done()
+			select {
+			case sshSem <- struct{}{}:
+				defer func() { <-sshSem }()
+			case <-ctx.Done():
+				return
+			}
+
+			slog.Warn("Restarting active prover", "cluster_ip", cluster.IP, "prover", prover)
+			proverRestartsTotal.WithLabelValues(cluster.IP).Inc()
+			if err := sshDockerCompose(ctx, cluster, prover, "restart"); err != nil {
+				return
+			}
+			if err := verifyRunning(ctx, cluster, prover); err != nil {
+				slog.Error("Prover still not running after restart",
+					"cluster_ip", cluster.IP, "prover", prover, "error", err)
+				return
+			}
+			slog.Info("Prover restarted", "cluster_ip", cluster.IP, "prover", prover)
+		}(chk.cluster, chk.prover)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckProversRestartsCrashed(t *testing.T) {
+	withConfigLines(t)
+	srv := startSSHServer(t)
+	if err := switchProver(context.Background(), 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	srv.crash(cluster2, prover1)
+	srv.reset()
+
+	checkProvers(context.Background())
+	if got := srv.lifecycleOn(cluster1); len(got) != 0 {
+		t.Errorf("%s got %q, want it left alone", cluster1, got)
+	}
+	if got, want := srv.lifecycleOn(cluster2), []string{prover1 + " restart"}; !slices.Equal(got, want) {
+		t.Errorf("%s got %q, want %q", cluster2, got, want)
+	}
+}
+
+func TestCheckProversChecksWithoutLock(t *testing.T) {
+	withConfigLines(t)
+	srv := startSSHServer(t)
+	if err := switchProver(context.Background(), 1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	srv.crash(cluster2, prover1)
+	srv.reset()
+
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	srv.script = func(cluster, cmd string) (string, int, bool) {
+		if cluster == cluster2 && strings.HasSuffix(cmd, " ps --all --format json") {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+		}
+		return "", 0, false
+	}
+	done := make(chan struct{})
+	go func() {
+		checkProvers(context.Background())
+		close(done)
+	}()
+
+	<-blocked
+	if !mu.TryLock() {
+		close(release)
+		t.Fatal("checkProvers holds mu while checking")
+	}
+	// A switch moves the cluster on while its check is still running.
+	clusterProvers[1] = 2
+	mu.Unlock()
+	close(release)
+	<-done
+
+	if got := srv.lifecycleOn(cluster2); len(got) != 0 {
+		t.Errorf("%s got %q after it was reassigned", cluster2, got)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const webhookTimeout = 5 * time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhooksPending tracks deliveries and post-switch hooks still in flight so
+// -once can wait for them before exiting.
+var webhooksPending sync.WaitGroup
+
+// switchEvent is recorded in the history and posted to webhookURL whenever
+// the prover state changes.
+type switchEvent struct {
+	OldProver    int          `json:"old_prover"`
+	NewProver    int          `json:"new_prover"`
+	SplitMode    bool         `json:"split_mode"`
+	SplitProvers []int        `json:"split_provers,omitempty"`
+	Timestamp    time.Time    `json:"timestamp"`
+	Reason       string       `json:"reason"`
+	Orders       map[int]bool `json:"orders"`                // last poll's assigned flag per prover
+	NotServing   []int        `json:"not_serving,omitempty"` // provers that failed the serving probe
+}
+
+// notifySwitch posts ev to the webhook in the background so a slow receiver
+// never holds up a switch. Failures are logged and counted, not retried.
+func notifySwitch(ev switchEvent) {
+	if webhookURL == "" {
+		return
+	}
+	if dryRun {
+		slog.Info("Dry run: would post switch webhook", "url", webhookURL, "event", ev)
+		return
+	}
+
+	webhooksPending.Add(1)
+	go func() {
+		defer webhooksPending.Done()
+		if err := postWebhook(ev); err != nil {
+			webhookFailuresTotal.Inc()
+			slog.Warn("Switch webhook failed", "url", webhookURL, "error", err)
+		}
+	}()
+}
+
+func postWebhook(ev switchEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}